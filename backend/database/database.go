@@ -2,7 +2,9 @@ package database
 
 import (
 	"fmt"
+	"log"
 	"os"
+	"time"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -26,7 +28,10 @@ func InitDatabase() (*gorm.DB, error) {
 
 	// Open the database connection
 	var err error
-	db, err = gorm.Open(postgres.Open(ConnStr), &gorm.Config{})
+	db, err = gorm.Open(postgres.Open(ConnStr), &gorm.Config{
+		// Report unique constraint violations as gorm.ErrDuplicatedKey
+		TranslateError: true,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -38,6 +43,11 @@ func GetDB() *gorm.DB {
 	return db
 }
 
+// SetDB replaces the shared connection, e.g. with an in-memory database in tests
+func SetDB(conn *gorm.DB) {
+	db = conn
+}
+
 func CloseDB() {
 	db, _ := db.DB()
 	db.Close()
@@ -45,8 +55,80 @@ func CloseDB() {
 
 func AutoMigrateModels(db *gorm.DB) {
 
+	// Accounts from before canonical emails have none, and older ones may share one since it
+	// wasn't unique, which the unique index can't be built over. Fill it in from the email and
+	// give every account but the earliest a canonical email no new signup can match.
+	if db.Migrator().HasTable(&User{}) {
+		if !db.Migrator().HasColumn(&User{}, "CanonicalEmail") {
+			db.Migrator().AddColumn(&User{}, "CanonicalEmail")
+		}
+		db.Model(&User{}).Where("canonical_email IS NULL OR canonical_email = ''").
+			UpdateColumn("canonical_email", gorm.Expr("LOWER(TRIM(email))"))
+		db.Model(&User{}).
+			Where("id NOT IN (?)", db.Model(&User{}).Select("MIN(id)").Group("canonical_email")).
+			UpdateColumn("canonical_email", gorm.Expr("canonical_email || '#' || id"))
+		if db.Migrator().HasIndex(&User{}, "idx_users_canonical_email") {
+			db.Migrator().DropIndex(&User{}, "idx_users_canonical_email")
+		}
+	}
 	db.AutoMigrate(&User{})
+	// Replace the randomly generated public IDs of older accounts, which could collide
+	db.Model(&User{}).Where("user_id <> id").UpdateColumn("user_id", gorm.Expr("id"))
 	db.AutoMigrate(&Book{})
+	db.AutoMigrate(&PriceTier{})
 	db.AutoMigrate(&CartItem{})
+	// Older databases may hold several live reviews by one user for a book, which the unique
+	// index can't be built over. Keep the earliest and soft-delete the rest.
+	if db.Migrator().HasTable(&Review{}) {
+		db.Model(&Review{}).
+			Where("id NOT IN (?)", db.Model(&Review{}).Select("MIN(id)").Group("user_id, book_id")).
+			Update("deleted_at", time.Now())
+	}
 	db.AutoMigrate(&Review{})
+	db.AutoMigrate(&UserNote{})
+	db.AutoMigrate(&Order{})
+	db.AutoMigrate(&OrderItem{})
+	db.AutoMigrate(&RefreshToken{})
+}
+
+// DeactivateInactiveUsers deactivates non-admin accounts that haven't logged in since the cutoff
+// and ends their sessions. Accounts that never logged in are judged by when they were created.
+func DeactivateInactiveUsers(cutoff time.Time) (int64, error) {
+	var count int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var ids []uint
+		if err := tx.Model(&User{}).
+			Where("active = ? AND role <> ?", true, UserRoleAdmin).
+			Where("COALESCE(last_login_at, created_at) < ?", cutoff).
+			Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		result := tx.Model(&User{}).Where("id IN ?", ids).UpdateColumn("active", false)
+		if result.Error != nil {
+			return result.Error
+		}
+		count = result.RowsAffected
+
+		return tx.Model(&RefreshToken{}).
+			Where("user_id IN ? AND revoked_at IS NULL", ids).
+			UpdateColumn("revoked_at", time.Now()).Error
+	})
+	return count, err
+}
+
+// StartInactivityJob deactivates accounts idle for longer than maxIdle, checking once per interval
+func StartInactivityJob(maxIdle, interval time.Duration) {
+	for {
+		count, err := DeactivateInactiveUsers(time.Now().Add(-maxIdle))
+		if err != nil {
+			log.Printf("Failed to deactivate inactive users: %v", err)
+		} else if count > 0 {
+			log.Printf("Deactivated %d inactive users", count)
+		}
+		time.Sleep(interval)
+	}
 }
@@ -1,6 +1,11 @@
 package database
 
 import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
 	"gorm.io/gorm"
 )
 
@@ -20,35 +25,171 @@ type User struct {
 	Email     string   `json:"email"`
 	Password  []byte   `json:"-"`
 	Role      UserRole `json:"role"`
+
+	Active      bool       `json:"active" gorm:"default:true"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+
+	// FailedLogins counts consecutive wrong passwords; reaching the limit locks login until LockedUntil
+	FailedLogins int        `json:"-"`
+	LockedUntil  *time.Time `json:"-"`
+
+	// CanonicalEmail is the lowercased, optionally alias-stripped email. Live accounts can't
+	// share one, so the database settles concurrent signups with the same email.
+	CanonicalEmail string `json:"-" gorm:"uniqueIndex:idx_users_unique_canonical_email,where:deleted_at IS NULL"`
+}
+
+// BeforeCreate falls back to the trimmed, lowercased email when no canonical email was given
+func (u *User) BeforeCreate(tx *gorm.DB) error {
+	if u.CanonicalEmail == "" {
+		u.CanonicalEmail = strings.ToLower(strings.TrimSpace(u.Email))
+	}
+	return nil
+}
+
+// AfterCreate mirrors the auto-increment ID into UserID, so the public ID is unique too
+func (u *User) AfterCreate(tx *gorm.DB) error {
+	u.UserID = u.ID
+	return tx.Model(u).UpdateColumn("user_id", u.ID).Error
 }
 
 type Book struct {
-	ID            uint    `json:"id"`
-	Title         string  `json:"title"`
-	Author        string  `json:"author"`
-	ISBN          string  `json:"isbn"`
-	Genre         string  `json:"genre"`
-	Price         float64 `json:"price"`
-	Quantity      int     `json:"quantity"`
-	Description   string  `json:"description"`
-	Image         string  `json:"image"`
-	Path          string  `json:"path"`
-	AverageRating float64 `json:"average_rating"`
+	ID            uint        `json:"id"`
+	Title         string      `json:"title"`
+	Author        string      `json:"author"`
+	ISBN          string      `json:"isbn"`
+	Genre         string      `json:"genre"`
+	Price         float64     `json:"price"`
+	Quantity      int         `json:"quantity"`
+	Description   string      `json:"description"`
+	Image         string      `json:"image"`
+	Path          string      `json:"-"` // Server-side location of the book file, never sent to clients
+	AverageRating float64     `json:"average_rating"`
+	ReviewCount   int         `json:"review_count" gorm:"-"`
+	PriceTiers    []PriceTier `json:"price_tiers" gorm:"foreignKey:BookID"`
+	Featured      bool        `json:"featured"`
+
+	// ReorderThreshold overrides the REORDER_THRESHOLD default when set
+	ReorderThreshold *int `json:"reorder_threshold"`
+	NeedsReorder     bool `json:"needs_reorder" gorm:"-"`
+
+	// Pre-order books can be carted before ReleaseDate even without stock
+	PreOrder      bool       `json:"pre_order"`
+	ReleaseDate   *time.Time `json:"release_date"`
+	PreOrderBadge bool       `json:"pre_order_badge" gorm:"-"`
+
+	// MaxPerUser caps how many copies one user can buy; nil means unlimited
+	MaxPerUser *uint `json:"max_per_user"`
+
+	CreatedAt time.Time      `json:"created_at"`
+	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+// DefaultReorderThreshold returns the stock level at which books are flagged for reordering
+func DefaultReorderThreshold() int {
+	threshold, err := strconv.Atoi(os.Getenv("REORDER_THRESHOLD"))
+	if err != nil || threshold < 0 {
+		return 5
+	}
+	return threshold
+}
+
+// EffectiveReorderThreshold returns the book's own threshold, or the default if it has none
+func (b *Book) EffectiveReorderThreshold() int {
+	if b.ReorderThreshold != nil {
+		return *b.ReorderThreshold
+	}
+	return DefaultReorderThreshold()
+}
+
+// IsUnreleasedPreOrder reports whether the book is on pre-order and not yet released
+func (b *Book) IsUnreleasedPreOrder() bool {
+	return b.PreOrder && (b.ReleaseDate == nil || time.Now().Before(*b.ReleaseDate))
+}
+
+// AfterFind derives the NeedsReorder and PreOrderBadge flags whenever a book is loaded
+func (b *Book) AfterFind(tx *gorm.DB) error {
+	b.NeedsReorder = b.Quantity <= b.EffectiveReorderThreshold()
+	b.PreOrderBadge = b.IsUnreleasedPreOrder()
+	return nil
+}
+
+// PriceTier is a bulk discount applied when a cart line reaches MinQuantity copies
+type PriceTier struct {
+	ID              uint    `json:"id"`
+	BookID          uint    `json:"book_id"`
+	MinQuantity     uint    `json:"min_quantity"`
+	DiscountPercent float64 `json:"discount_percent"`
 }
 
 // Define a struct to represent a cart item
 type CartItem struct {
-    gorm.Model
-    UserID   uint    `json:"user_id"`
-    BookID   uint    `json:"book_id"`
-    Subtotal float64 `json:"subtotal"` // Change the data type to float64
-    Quantity uint    `json:"quantity"`
+	gorm.Model
+	UserID   uint    `json:"user_id" gorm:"uniqueIndex:idx_cart_items_user_book,where:deleted_at IS NULL"`
+	BookID   uint    `json:"book_id" gorm:"uniqueIndex:idx_cart_items_user_book,where:deleted_at IS NULL"`
+	Subtotal float64 `json:"subtotal"` // Change the data type to float64
+	Quantity uint    `json:"quantity"`
+
+	// PriceChanged is set when the subtotal was recomputed on read and differs from the stored one
+	PriceChanged bool `json:"price_changed,omitempty" gorm:"-"`
 }
 
 type Review struct {
 	gorm.Model
-	BookID    uint   `json:"book_id"`
-	UserID    uint   `json:"user_id"`
-	Rating    int    `json:"rating"`
-	Comment   string `json:"comment"`
+	BookID  uint   `json:"book_id" gorm:"uniqueIndex:idx_reviews_user_book,where:deleted_at IS NULL"`
+	UserID  uint   `json:"user_id" gorm:"uniqueIndex:idx_reviews_user_book,where:deleted_at IS NULL"`
+	Rating  int    `json:"rating"`
+	Comment string `json:"comment"`
+}
+
+// UserNote is an internal note left by an admin on a user's account
+type UserNote struct {
+	gorm.Model
+	UserID   uint   `json:"user_id"`
+	AuthorID uint   `json:"author_id"`
+	Text     string `json:"text"`
+}
+
+// OrderStatus represents where an order is in its lifecycle
+type OrderStatus string
+
+const (
+	OrderStatusCompleted OrderStatus = "completed"
+
+	// OrderStatusPreOrdered marks orders and items for books that haven't been released yet.
+	// Their stock is taken when the book is released, which completes them.
+	OrderStatusPreOrdered OrderStatus = "pre_ordered"
+)
+
+// Order is a cart that has been checked out
+type Order struct {
+	gorm.Model
+	OrderNumber string      `json:"order_number" gorm:"uniqueIndex;size:32"`
+	UserID      uint        `json:"user_id" gorm:"index"`
+	Total       float64     `json:"total"`
+	Status      OrderStatus `json:"status"`
+	Items       []OrderItem `json:"items" gorm:"foreignKey:OrderID"`
+}
+
+// OrderItem is one book in an order, priced as it was at the time of purchase
+type OrderItem struct {
+	ID        uint    `json:"id"`
+	OrderID   uint    `json:"order_id" gorm:"index"`
+	BookID    uint    `json:"book_id"`
+	Title     string  `json:"title"`
+	Quantity  uint    `json:"quantity"`
+	UnitPrice float64 `json:"unit_price"`
+	Subtotal  float64 `json:"subtotal"`
+
+	// Status is pre_ordered until the book is released, then completed
+	Status OrderStatus `json:"status" gorm:"default:completed;index"`
+}
+
+// RefreshToken is a login session. Only a hash of the token is stored, and access tokens name
+// their session in the "sid" claim so revoking the session ends them too.
+type RefreshToken struct {
+	gorm.Model
+	UserID    uint   `gorm:"index"`
+	TokenHash string `gorm:"uniqueIndex;size:64"`
+	ExpiresAt time.Time
+	RevokedAt *time.Time
 }
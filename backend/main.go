@@ -2,12 +2,17 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/joho/godotenv"
 
 	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/middleware"
 	"github.com/mohammadshaad/golang-book-store-backend/routes"
 )
 
@@ -29,13 +34,29 @@ func main() {
 	// Auto-migrate the models to create the necessary tables
 	database.AutoMigrateModels(db)
 
-	// Create a Fiber app
-	app := fiber.New()
+	// Deactivate accounts that haven't logged in for INACTIVITY_DAYS (unset or 0 disables it)
+	if days, _ := strconv.Atoi(os.Getenv("INACTIVITY_DAYS")); days > 0 {
+		go database.StartInactivityJob(time.Duration(days)*24*time.Hour, 24*time.Hour)
+	}
+
+	// Take the stock for pre-orders once their books are released
+	go routes.StartPreOrderReleaseJob(time.Hour)
+
+	// Create a Fiber app that logs handler errors and hides their details from clients
+	app := fiber.New(fiber.Config{
+		ErrorHandler: middleware.ErrorHandler,
+		// Leave room for a cover and a book file at the UPLOAD_MAX_MB upload limit
+		BodyLimit: routes.UploadBodyLimit(),
+	})
+
+	// Tag every request with an ID so errors can be traced in the logs
+	app.Use(requestid.New())
 
 	// Enable CORS
 	app.Use(cors.New(cors.Config{
-		AllowOrigins: "http://localhost",                       // Update with the actual URL of your React app
-		AllowHeaders: "Origin, Content-Type, Accept, Authorization", // Include "Authorization" here
+		AllowOrigins:  "http://localhost",                            // Update with the actual URL of your React app
+		AllowHeaders:  "Origin, Content-Type, Accept, Authorization", // Include "Authorization" here
+		ExposeHeaders: "X-Refreshed-Token",                           // Let the client read silently refreshed tokens
 	}))
 
 	// Define routes
@@ -1,41 +1,152 @@
 package middleware
 
 import (
+	"context"
+	"errors"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/mohammadshaad/golang-book-store-backend/database"
 )
 
-// checkJWTValidity middleware checks if the JWT is valid
+// checkJWTValidity middleware checks if the JWT is valid and its login session hasn't been revoked
+// or expired. The session is kept in c.Locals("session") for the middleware that follows.
 func CheckJWTValidity(c *fiber.Ctx) error {
 	token := c.Locals("user").(*jwt.Token)
 	if token == nil || !token.Valid {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Login first",
-		})
+		return RespondError(c, fiber.StatusUnauthorized, "Login first")
+	}
+
+	// Logging out revokes the session, which ends its access tokens straight away
+	sessionID, _ := token.Claims.(jwt.MapClaims)["sid"].(float64)
+	var session database.RefreshToken
+	if err := database.GetDB().WithContext(c.UserContext()).
+		Where("id = ? AND revoked_at IS NULL AND expires_at > ?", uint(sessionID), time.Now()).
+		First(&session).Error; err != nil {
+		return RespondError(c, fiber.StatusUnauthorized, "Session has ended, please log in again")
 	}
+
+	c.Locals("session", &session)
 	return c.Next()
 }
 
-// checkAdminRole middleware checks if the user has the "admin" role
-func CheckAdminRole(c *fiber.Ctx) error {
-	// Get the user ID from the JWT payload
-	userID := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)["user_id"].(float64)
+// RequireRole middleware loads the user from the JWT and rejects the request with 403 unless
+// they have the given role. Admins are allowed through every role check.
+func RequireRole(role database.UserRole) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		// Get the user ID from the JWT payload
+		userID := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)["user_id"].(float64)
 
-	// Find the user in the database
-	var user database.User
-	if err := database.GetDB().First(&user, uint(userID)).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		// Find the user in the database
+		var user database.User
+		if err := database.GetDB().WithContext(c.UserContext()).First(&user, uint(userID)).Error; err != nil {
+			return RespondError(c, fiber.StatusNotFound, "User not found")
+		}
+
+		if user.Role != role && user.Role != database.UserRoleAdmin {
+			return RespondError(c, fiber.StatusForbidden, "You don't have permission to do this")
+		}
+
+		return c.Next()
 	}
+}
+
+// CheckAdminRole middleware checks if the user has the "admin" role
+var CheckAdminRole = RequireRole(database.UserRoleAdmin)
 
-	// Check if the user is an admin
-	if user.Role != database.UserRoleAdmin {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Unauthorized",
-		})
+// Timeout middleware attaches a deadline to the request context so queries run with
+// c.UserContext() are cancelled, and responds with 504 once the deadline has passed
+func Timeout(timeout time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx, cancel := context.WithTimeout(c.UserContext(), timeout)
+		defer cancel()
+
+		c.SetUserContext(ctx)
+		err := c.Next()
+
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return RespondError(c, fiber.StatusGatewayTimeout, "Request timed out")
+		}
+		return err
 	}
+}
 
-	return c.Next()
+// InternalError wraps an unexpected error with a message that is safe to show to clients
+type InternalError struct {
+	Message string
+	Err     error
+	Stack   []byte
+}
+
+func (e *InternalError) Error() string {
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *InternalError) Unwrap() error {
+	return e.Err
+}
+
+// Internal wraps err so the ErrorHandler logs it with a stack trace and only sends message to the client
+func Internal(err error, message string) error {
+	return &InternalError{Message: message, Err: err, Stack: debug.Stack()}
+}
+
+// ErrorHandler logs errors returned by handlers and responds with a sanitized message
+func ErrorHandler(c *fiber.Ctx, err error) error {
+	// Errors raised by Fiber itself (404 routes, bad requests) are safe to return as-is
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		return RespondError(c, fiberErr.Code, fiberErr.Message)
+	}
+
+	message := "Internal server error"
+	stack := debug.Stack()
+	var internalErr *InternalError
+	if errors.As(err, &internalErr) {
+		message = internalErr.Message
+		stack = internalErr.Stack
+	}
+
+	slog.Error("request failed",
+		"request_id", c.GetRespHeader(fiber.HeaderXRequestID),
+		"method", c.Method(),
+		"path", c.Path(),
+		"error", err.Error(),
+		"stack", string(stack),
+	)
+
+	return RespondError(c, fiber.StatusInternalServerError, message)
+}
+
+// RefreshNearExpiry middleware sends a fresh token in the X-Refreshed-Token header when the
+// request's valid token expires within the window. Expired tokens never get this far. When
+// CheckJWTValidity has loaded the session, issue is given its end so the new token can't
+// outlive it, and a token that already lasts until then isn't reissued.
+func RefreshNearExpiry(window time.Duration, issue func(claims jwt.MapClaims, notAfter time.Time) (string, error)) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		token, ok := c.Locals("user").(*jwt.Token)
+		if !ok || !token.Valid {
+			return c.Next()
+		}
+
+		claims := token.Claims.(jwt.MapClaims)
+		exp, hasExp := claims["exp"].(float64)
+		_, hasUser := claims["user_id"].(float64)
+		var notAfter time.Time
+		if session, ok := c.Locals("session").(*database.RefreshToken); ok {
+			notAfter = session.ExpiresAt
+		}
+		outlivesSession := !notAfter.IsZero() && int64(exp) >= notAfter.Unix()
+
+		if hasExp && hasUser && !outlivesSession && time.Until(time.Unix(int64(exp), 0)) < window {
+			if refreshed, err := issue(claims, notAfter); err == nil {
+				c.Set("X-Refreshed-Token", refreshed)
+			}
+		}
+
+		return c.Next()
+	}
 }
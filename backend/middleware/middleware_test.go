@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestTimeout_CancelsSlowQuery(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+
+	app := fiber.New()
+	app.Use(Timeout(50 * time.Millisecond))
+	app.Get("/slow", func(c *fiber.Ctx) error {
+		// Count far enough that the query only finishes if it is never cancelled
+		err := db.WithContext(c.UserContext()).
+			Exec("WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 1000000000) SELECT COUNT(*) FROM n").
+			Error
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to run query",
+			})
+		}
+		return c.SendString("done")
+	})
+
+	start := time.Now()
+	resp, err := app.Test(httptest.NewRequest("GET", "/slow", nil), -1)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+
+	if resp.StatusCode != fiber.StatusGatewayTimeout {
+		t.Errorf("Expected status 504, but got %d", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the query to be cancelled quickly, but it took %v", elapsed)
+	}
+}
+
+func TestErrorHandler_LogsAndSanitizes(t *testing.T) {
+	var logs bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	app := fiber.New(fiber.Config{ErrorHandler: ErrorHandler})
+	app.Use(requestid.New())
+	app.Get("/fail", func(c *fiber.Ctx) error {
+		return Internal(errors.New("pq: password authentication failed for user \"postgres\""), "Failed to fetch books")
+	})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/fail", nil), -1)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != fiber.StatusInternalServerError {
+		t.Errorf("Expected status 500, but got %d", resp.StatusCode)
+	}
+	if string(body) != `{"success":false,"error":{"message":"Failed to fetch books"}}` {
+		t.Errorf("Expected a sanitized body, but got %s", body)
+	}
+
+	requestID := resp.Header.Get(fiber.HeaderXRequestID)
+	if !strings.Contains(logs.String(), "request_id="+requestID) || !strings.Contains(logs.String(), "password authentication failed") {
+		t.Errorf("Expected the error and request ID to be logged, but got %q", logs.String())
+	}
+}
+
+func TestRefreshNearExpiry(t *testing.T) {
+	tests := []struct {
+		name        string
+		expiresIn   time.Duration
+		sessionEnds time.Duration
+		refreshed   bool
+	}{
+		{"within window", 10 * time.Minute, 0, true},
+		{"outside window", 5 * time.Hour, 0, false},
+		{"within window before session ends", 10 * time.Minute, 24 * time.Hour, true},
+		{"token lasts until session ends", 10 * time.Minute, 10 * time.Minute, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			var notAfter time.Time
+			app := fiber.New()
+			app.Use(func(c *fiber.Ctx) error {
+				c.Locals("user", &jwt.Token{
+					Valid: true,
+					Claims: jwt.MapClaims{
+						"user_id": float64(7),
+						"exp":     float64(now.Add(tt.expiresIn).Unix()),
+					},
+				})
+				if tt.sessionEnds > 0 {
+					c.Locals("session", &database.RefreshToken{ExpiresAt: now.Add(tt.sessionEnds)})
+				}
+				return c.Next()
+			})
+			app.Use(RefreshNearExpiry(time.Hour, func(claims jwt.MapClaims, sessionEnds time.Time) (string, error) {
+				notAfter = sessionEnds
+				return "fresh-token-for-7", nil
+			}))
+			app.Get("/", func(c *fiber.Ctx) error {
+				return c.SendString("ok")
+			})
+
+			resp, err := app.Test(httptest.NewRequest("GET", "/", nil), -1)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+
+			header := resp.Header.Get("X-Refreshed-Token")
+			if tt.refreshed && header != "fresh-token-for-7" {
+				t.Errorf("Expected a refreshed token, but got %q", header)
+			}
+			if !tt.refreshed && header != "" {
+				t.Errorf("Expected no refreshed token, but got %q", header)
+			}
+			if tt.refreshed && tt.sessionEnds > 0 && !notAfter.Equal(now.Add(tt.sessionEnds)) {
+				t.Errorf("Expected the new token to end with the session at %v, but got %v", now.Add(tt.sessionEnds), notAfter)
+			}
+		})
+	}
+}
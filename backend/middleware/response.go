@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Response is the envelope every JSON response is sent in
+type Response struct {
+	Success bool        `json:"success"`
+	Data    interface{} `json:"data,omitempty"`
+	Error   *ErrorBody  `json:"error,omitempty"`
+}
+
+// ErrorBody explains why a request failed. Fields maps each invalid request field to what is
+// wrong with it.
+type ErrorBody struct {
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// RespondOK sends data in a successful envelope
+func RespondOK(c *fiber.Ctx, data interface{}) error {
+	return c.JSON(Response{Success: true, Data: data})
+}
+
+// RespondError sends a failed envelope with the given status and message
+func RespondError(c *fiber.Ctx, status int, message string) error {
+	return c.Status(status).JSON(Response{Error: &ErrorBody{Message: message}})
+}
+
+// RespondErrorData sends a failed envelope that also carries data the client can act on,
+// such as how many copies can still be added
+func RespondErrorData(c *fiber.Ctx, status int, message string, data interface{}) error {
+	return c.Status(status).JSON(Response{Data: data, Error: &ErrorBody{Message: message}})
+}
+
+// RespondValidationError sends a 400 envelope listing the fields that failed validation
+func RespondValidationError(c *fiber.Ctx, message string, err error) error {
+	body := &ErrorBody{Message: message}
+
+	var validationErrors validator.ValidationErrors
+	if errors.As(err, &validationErrors) {
+		body.Fields = make(map[string]string, len(validationErrors))
+		for _, fieldErr := range validationErrors {
+			body.Fields[fieldPath(fieldErr)] = describeFieldError(fieldErr)
+		}
+	}
+
+	return c.Status(fiber.StatusBadRequest).JSON(Response{Error: body})
+}
+
+// Name a field by its path in the request, e.g. "items[0].book_id". Named request structs
+// start the namespace with their type name, which is dropped. Anonymous ones have no such
+// root, and their first segment is a field whose JSON name differs from its Go name.
+func fieldPath(fieldErr validator.FieldError) string {
+	namespace := fieldErr.Namespace()
+	root, rest, nested := strings.Cut(namespace, ".")
+	structRoot, _, _ := strings.Cut(fieldErr.StructNamespace(), ".")
+	if nested && root == structRoot {
+		return rest
+	}
+	return namespace
+}
+
+// Describe a failed validation rule in words
+func describeFieldError(fieldErr validator.FieldError) string {
+	switch fieldErr.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be a valid email address"
+	case "min", "gte", "max", "lte":
+		bound := "at least"
+		if fieldErr.Tag() == "max" || fieldErr.Tag() == "lte" {
+			bound = "at most"
+		}
+		switch fieldErr.Kind() {
+		case reflect.String:
+			return fmt.Sprintf("must be %s %s characters long", bound, fieldErr.Param())
+		case reflect.Slice, reflect.Array, reflect.Map:
+			return fmt.Sprintf("must have %s %s items", bound, fieldErr.Param())
+		}
+		return fmt.Sprintf("must be %s %s", bound, fieldErr.Param())
+	case "oneof":
+		return fmt.Sprintf("must be one of %s", fieldErr.Param())
+	default:
+		return fmt.Sprintf("failed the %s check", fieldErr.Tag())
+	}
+}
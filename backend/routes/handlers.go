@@ -1,25 +1,99 @@
 package routes
 
 import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
 	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/middleware"
 
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/go-playground/validator/v10"
 
 	"github.com/golang-jwt/jwt/v4"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var validate *validator.Validate
 
 func init() {
 	validate = validator.New()
+
+	// Report validation failures by the JSON field names clients send
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+}
+
+// Get the database handle bound to the request context so cancellations and timeouts reach the driver
+func requestDB(c *fiber.Ctx) *gorm.DB {
+	return database.GetDB().WithContext(c.UserContext())
+}
+
+// Count a wrong password against the user. Once LOGIN_MAX_FAILURES consecutive failures are
+// reached the account is locked for LOGIN_LOCKOUT, and the time it unlocks is returned.
+func recordFailedLogin(db *gorm.DB, userID uint) (*time.Time, error) {
+	var lockedUntil *time.Time
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&database.User{}).Where("id = ?", userID).
+			UpdateColumn("failed_logins", gorm.Expr("failed_logins + 1")).Error; err != nil {
+			return err
+		}
+
+		var user database.User
+		if err := tx.Select("id", "failed_logins").First(&user, userID).Error; err != nil {
+			return err
+		}
+		if user.FailedLogins < intFromEnv("LOGIN_MAX_FAILURES", 5) {
+			return nil
+		}
+
+		until := time.Now().Add(durationFromEnv("LOGIN_LOCKOUT", 15*time.Minute))
+		lockedUntil = &until
+		return tx.Model(&user).UpdateColumns(map[string]interface{}{
+			"failed_logins": 0,
+			"locked_until":  until,
+		}).Error
+	})
+	return lockedUntil, err
+}
+
+// Reject a login attempt for a locked account, telling the client when to try again
+func loginLocked(c *fiber.Ctx, until time.Time) error {
+	retryAfter := int(math.Ceil(time.Until(until).Seconds()))
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter))
+	return middleware.RespondErrorData(c, fiber.StatusTooManyRequests, "Too many failed login attempts, try again later", fiber.Map{
+		"retry_after": retryAfter,
+	})
 }
 
 func LoginHandler(c *fiber.Ctx) error {
@@ -29,53 +103,143 @@ func LoginHandler(c *fiber.Ctx) error {
 	}
 
 	if err := c.BodyParser(&userData); err != nil {
-		return c.Status(400).JSON(fiber.Map{
-			"success": false,
-			"message": "Cannot parse JSON",
-		})
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Cannot parse JSON")
 	}
 
 	// Validate user input
 	if err := validate.Struct(userData); err != nil {
-		return c.Status(400).JSON(fiber.Map{
-			"success": false,
-			"message": "Invalid input data",
-			"errors":  err.(validator.ValidationErrors),
-		})
+		return middleware.RespondValidationError(c, "Invalid input data", err)
 	}
 
 	// Find the user in the database
 	var user database.User
-	if err := database.GetDB().Where("email = ?", userData.Email).First(&user).Error; err != nil {
+	if err := requestDB(c).Where("email = ?", userData.Email).First(&user).Error; err != nil {
 		// Handle database errors (e.g., no user with the given email)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return middleware.RespondError(c, fiber.StatusNotFound, "User not found")
+	}
+
+	// Refuse to check passwords while the account is locked after repeated failures
+	if user.LockedUntil != nil && time.Now().Before(*user.LockedUntil) {
+		return loginLocked(c, *user.LockedUntil)
 	}
 
 	// Compare the given password with the password in the database
 	if err := bcrypt.CompareHashAndPassword(user.Password, []byte(userData.Password)); err != nil {
+		lockedUntil, err := recordFailedLogin(requestDB(c), user.ID)
+		if err != nil {
+			return middleware.Internal(err, "Cannot log in")
+		}
+		if lockedUntil != nil {
+			return loginLocked(c, *lockedUntil)
+		}
+
 		// Handle password incorrect error
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Incorrect password",
-		})
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Incorrect password")
 	}
 
-	// Create a JWT token
-	token, err := CreateToken(user.ID)
+	// Start a session with an access token and a refresh token
+	token, refreshToken, err := createSession(requestDB(c), user.ID)
 	if err != nil {
 		// Handle token creation error
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Cannot log in",
-		})
+		return middleware.Internal(err, "Cannot log in")
+	}
+
+	response := fiber.Map{
+		"token":         token,
+		"refresh_token": refreshToken,
+	}
+
+	// Logging in reactivates a deactivated account and clears any failed attempts
+	updates := map[string]interface{}{"last_login_at": time.Now(), "failed_logins": 0, "locked_until": nil}
+	if !user.Active {
+		updates["active"] = true
+		response["notice"] = "Your account was inactive and has been reactivated"
+	}
+	if err := requestDB(c).Model(&user).UpdateColumns(updates).Error; err != nil {
+		log.Printf("Failed to record login for user %d: %v", user.ID, err)
 	}
 
 	// Return the token
-	return c.JSON(fiber.Map{
-		"success": true,
-		"token":   token,
-	})
+	return middleware.RespondOK(c, response)
+
+}
+
+// Email providers that ignore "+suffix" aliases, and whether they also ignore dots in the local part
+var aliasEmailProviders = map[string]bool{
+	"gmail.com":      true,
+	"googlemail.com": true,
+	"outlook.com":    false,
+	"hotmail.com":    false,
+	"live.com":       false,
+	"icloud.com":     false,
+	"fastmail.com":   false,
+	"protonmail.com": false,
+}
+
+// Canonicalize an email for uniqueness checks. It is always trimmed and lowercased, and when
+// EMAIL_ALIAS_CANONICALIZATION is enabled known providers' dot and plus aliases are removed.
+func canonicalizeEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if os.Getenv("EMAIL_ALIAS_CANONICALIZATION") != "true" {
+		return email
+	}
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	local, domain := email[:at], email[at+1:]
+
+	stripDots, known := aliasEmailProviders[domain]
+	if !known {
+		return email
+	}
+	if plus := strings.Index(local, "+"); plus >= 0 {
+		local = local[:plus]
+	}
+	if stripDots {
+		local = strings.ReplaceAll(local, ".", "")
+	}
+	if domain == "googlemail.com" {
+		domain = "gmail.com"
+	}
+
+	return local + "@" + domain
+}
+
+var (
+	commonPasswordsMu   sync.Mutex
+	commonPasswordsPath string
+	commonPasswords     map[string]bool
+)
+
+// Report whether a password is on the blocklist named by COMMON_PASSWORDS_FILE, one password
+// per line. The check is off when the variable is unset. The file is read once and reloaded
+// only if the path changes.
+func isCommonPassword(password string) (bool, error) {
+	path := os.Getenv("COMMON_PASSWORDS_FILE")
+	if path == "" {
+		return false, nil
+	}
+
+	commonPasswordsMu.Lock()
+	defer commonPasswordsMu.Unlock()
+
+	if path != commonPasswordsPath {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return false, err
+		}
+		commonPasswords = make(map[string]bool)
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				commonPasswords[strings.ToLower(line)] = true
+			}
+		}
+		commonPasswordsPath = path
+	}
 
+	return commonPasswords[strings.ToLower(password)], nil
 }
 
 func RegisterHandler(c *fiber.Ctx) error {
@@ -88,106 +252,120 @@ func RegisterHandler(c *fiber.Ctx) error {
 	}
 
 	if err := c.BodyParser(&userData); err != nil {
-		return c.Status(400).JSON(fiber.Map{
-			"success": false,
-			"message": "Cannot parse JSON",
-		})
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Cannot parse JSON")
 	}
 
 	// Validate user input
 	if err := validate.Struct(userData); err != nil {
-		return c.Status(400).JSON(fiber.Map{
-			"success": false,
-			"message": "Invalid input data",
-			"errors":  err.(validator.ValidationErrors),
-		})
+		return middleware.RespondValidationError(c, "Invalid input data", err)
+	}
+
+	// Reject passwords that are on the common password blocklist
+	common, err := isCommonPassword(userData.Password)
+	if err != nil {
+		return middleware.Internal(err, "Cannot check password")
+	}
+	if common {
+		return middleware.RespondError(c, fiber.StatusBadRequest, "This password is too common, please choose another")
 	}
 
-	// Check if the user already exists (email must be unique)
+	// Check if the user already exists (email must be unique, ignoring case and aliases)
+	canonicalEmail := canonicalizeEmail(userData.Email)
 	var user database.User
-	if err := database.GetDB().Where("email = ?", userData.Email).First(&user).Error; err == nil {
+	if err := requestDB(c).Where("canonical_email = ? OR LOWER(email) = ?", canonicalEmail, canonicalEmail).First(&user).Error; err == nil {
 		// User already exists, don't register again
-		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
-			"error": "User already exists",
-		})
+		return middleware.RespondError(c, fiber.StatusConflict, "User already exists")
 	}
 
-	// Generate a random numeric user ID
-	rand.Seed(time.Now().UnixNano())
-	userID := uint(rand.Intn(10000)) // Change the range as needed
-
 	// Hash password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(userData.Password), 10)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"success": false,
-			"message": "Cannot hash password",
-		})
+		return middleware.Internal(err, "Cannot hash password")
 	}
 
-	// Create a new user with the generated ID
+	// Create a new user, the database assigns the ID
 	newUser := database.User{
-		UserID:    userID,
 		FirstName: userData.FirstName,
 		LastName:  userData.LastName,
-		Email:     userData.Email,
+		Email:     strings.TrimSpace(userData.Email),
 		Password:  hashedPassword,
 		Role:      userData.Role,
+
+		CanonicalEmail: canonicalEmail,
 	}
 
 	// Save the user to the database
-	if err := database.GetDB().Create(&newUser).Error; err != nil {
-		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
-			"error": "User registration failed",
-		})
+	if err := requestDB(c).Create(&newUser).Error; err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return middleware.RespondError(c, fiber.StatusConflict, "User already exists")
+		}
+		return middleware.Internal(err, "User registration failed")
 	}
 
 	// Retrieve the auto-generated ID from the database
 	autoGeneratedID := newUser.ID
 
-	// Create a JWT token
-	token, err := CreateToken(autoGeneratedID)
+	// Start a session with an access token and a refresh token
+	token, refreshToken, err := createSession(requestDB(c), autoGeneratedID)
 	if err != nil {
 		// Handle token creation error
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Cannot log in",
-		})
+		return middleware.Internal(err, "Cannot log in")
 	}
 
-	// Return the token
-	return c.JSON(fiber.Map{
-		"success": true,
-		"token":   token,
+	// Return the tokens
+	return middleware.RespondOK(c, fiber.Map{
+		"token":         token,
+		"refresh_token": refreshToken,
 	})
 
 }
 
+// Report whether the caller may manage the account with the given ID: their own, or anyone's
+// if they are an admin. Also returns the caller's user ID.
+func canManageAccount(c *fiber.Ctx, userID uint) (uint, bool) {
+	claims := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	callerID := uint(claims["user_id"].(float64))
+	if callerID == userID {
+		return callerID, true
+	}
+
+	var caller database.User
+	if err := requestDB(c).First(&caller, callerID).Error; err != nil {
+		return callerID, false
+	}
+	return callerID, caller.Role == database.UserRoleAdmin
+}
+
 func DeactivateAccountHandler(c *fiber.Ctx) error {
 	// Get the "id" URL parameter and convert it to a uint
 	idStr := c.Params("id")
 	id, err := strconv.ParseUint(idStr, 10, 32)
 	if err != nil {
 		// Handle invalid ID format
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid ID format",
-		})
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid ID format")
 	}
 
 	// Find the user in the database
 	var user database.User
-	if err := database.GetDB().First(&user, uint(id)).Error; err != nil {
+	if err := requestDB(c).First(&user, uint(id)).Error; err != nil {
 		// Handle database errors (e.g., no user with the given ID)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return middleware.RespondError(c, fiber.StatusNotFound, "User not found")
+	}
+
+	// Users can only deactivate their own account, unless they are an admin
+	if _, allowed := canManageAccount(c, user.ID); !allowed {
+		return middleware.RespondError(c, fiber.StatusForbidden, "You can only deactivate your own account")
 	}
 
 	// Deactivate the user
-	if err := database.GetDB().Model(&user).Update("active", false).Error; err != nil {
+	if err := requestDB(c).Model(&user).Update("active", false).Error; err != nil {
 		// Handle database errors
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Cannot deactivate user",
-		})
+		return middleware.Internal(err, "Cannot deactivate user")
+	}
+
+	// End all of the user's sessions
+	if err := revokeSessions(requestDB(c), user.ID); err != nil {
+		return middleware.Internal(err, "Cannot deactivate user")
 	}
 
 	// Set the token's expiration time to now thereby invalidating it
@@ -198,8 +376,7 @@ func DeactivateAccountHandler(c *fiber.Ctx) error {
 		HTTPOnly: true,
 	})
 
-	return c.JSON(fiber.Map{
-		"success": true,
+	return middleware.RespondOK(c, fiber.Map{
 		"message": "User deactivated successfully",
 	})
 }
@@ -210,30 +387,28 @@ func ActivateAccountHandler(c *fiber.Ctx) error {
 	id, err := strconv.ParseUint(idStr, 10, 32)
 	if err != nil {
 		// Handle invalid ID format
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid ID format",
-		})
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid ID format")
 	}
 
 	// Find the user in the database
 	var user database.User
-	if err := database.GetDB().First(&user, uint(id)).Error; err != nil {
+	if err := requestDB(c).First(&user, uint(id)).Error; err != nil {
 		// Handle database errors (e.g., no user with the given ID)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return middleware.RespondError(c, fiber.StatusNotFound, "User not found")
+	}
+
+	// Users can only activate their own account, unless they are an admin
+	if _, allowed := canManageAccount(c, user.ID); !allowed {
+		return middleware.RespondError(c, fiber.StatusForbidden, "You can only activate your own account")
 	}
 
 	// Activate the user
-	if err := database.GetDB().Model(&user).Update("active", true).Error; err != nil {
+	if err := requestDB(c).Model(&user).Update("active", true).Error; err != nil {
 		// Handle database errors
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Cannot activate user",
-		})
+		return middleware.Internal(err, "Cannot activate user")
 	}
 
-	return c.JSON(fiber.Map{
-		"success": true,
+	return middleware.RespondOK(c, fiber.Map{
 		"message": "User activated successfully",
 	})
 }
@@ -244,26 +419,30 @@ func DeleteAccountHandler(c *fiber.Ctx) error {
 	id, err := strconv.ParseUint(idStr, 10, 32)
 	if err != nil {
 		// Handle invalid ID format
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid ID format",
-		})
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid ID format")
 	}
 
 	// Find the user in the database
 	var user database.User
-	if err := database.GetDB().First(&user, uint(id)).Error; err != nil {
+	if err := requestDB(c).First(&user, uint(id)).Error; err != nil {
 		// Handle database errors (e.g., no user with the given ID)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return middleware.RespondError(c, fiber.StatusNotFound, "User not found")
+	}
+
+	// Users can only delete their own account, unless they are an admin
+	if _, allowed := canManageAccount(c, user.ID); !allowed {
+		return middleware.RespondError(c, fiber.StatusForbidden, "You can only delete your own account")
 	}
 
 	// Delete the user's account from the database
-	if err := database.GetDB().Delete(&user).Error; err != nil {
+	if err := requestDB(c).Delete(&user).Error; err != nil {
 		// Handle database errors
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Cannot delete user account",
-		})
+		return middleware.Internal(err, "Cannot delete user account")
+	}
+
+	// End all of the user's sessions
+	if err := revokeSessions(requestDB(c), user.ID); err != nil {
+		return middleware.Internal(err, "Cannot delete user account")
 	}
 
 	// Set the token's expiration time to now thereby invalidating it
@@ -274,8 +453,7 @@ func DeleteAccountHandler(c *fiber.Ctx) error {
 		HTTPOnly: true,
 	})
 
-	return c.JSON(fiber.Map{
-		"success": true,
+	return middleware.RespondOK(c, fiber.Map{
 		"message": "User account deleted successfully",
 	})
 }
@@ -289,16 +467,13 @@ func GetUserNameHandler(c *fiber.Ctx) error {
 
 	// Find the user in the database
 	var user database.User
-	if err := database.GetDB().First(&user, userID).Error; err != nil {
+	if err := requestDB(c).First(&user, userID).Error; err != nil {
 		// Handle database errors (e.g., no user with the given ID)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return middleware.RespondError(c, fiber.StatusNotFound, "User not found")
 	}
 
-	return c.JSON(fiber.Map{
-		"success": true,
-		"name":    user.FirstName,
+	return middleware.RespondOK(c, fiber.Map{
+		"name": user.FirstName,
 	})
 }
 
@@ -311,20 +486,25 @@ func UserHomePageHandler(c *fiber.Ctx) error {
 
 	// Find the user in the database
 	var user database.User
-	if err := database.GetDB().First(&user, userID).Error; err != nil {
+	if err := requestDB(c).First(&user, userID).Error; err != nil {
 		// Handle database errors (e.g., no user with the given ID)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return middleware.RespondError(c, fiber.StatusNotFound, "User not found")
 	}
 
-	return c.JSON(fiber.Map{
-		"success": true,
-		"name":    user.FirstName,
+	return middleware.RespondOK(c, fiber.Map{
+		"name": user.FirstName,
 	})
 }
 
 func LogoutHandler(c *fiber.Ctx) error {
+	// Revoke the session so its access and refresh tokens stop working
+	sessionID, _ := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)["sid"].(float64)
+	if err := requestDB(c).Model(&database.RefreshToken{}).
+		Where("id = ? AND revoked_at IS NULL", uint(sessionID)).
+		UpdateColumn("revoked_at", time.Now()).Error; err != nil {
+		return middleware.Internal(err, "Cannot log out")
+	}
+
 	// Set the token's expiration time to now thereby invalidating it
 	c.Cookie(&fiber.Cookie{
 		Name:     "jwt",
@@ -334,8 +514,7 @@ func LogoutHandler(c *fiber.Ctx) error {
 	})
 
 	// Return a success response
-	return c.JSON(fiber.Map{
-		"success": true,
+	return middleware.RespondOK(c, fiber.Map{
 		"message": "User logged out successfully",
 	})
 }
@@ -346,21 +525,17 @@ func Profile(c *fiber.Ctx) error {
 	id, err := strconv.ParseUint(idStr, 10, 32)
 	if err != nil {
 		// Handle invalid ID format
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid ID format",
-		})
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid ID format")
 	}
 
 	// Find the user in the database
 	var user database.User
-	if err := database.GetDB().First(&user, uint(id)).Error; err != nil {
+	if err := requestDB(c).First(&user, uint(id)).Error; err != nil {
 		// Handle database errors (e.g., no user with the given ID)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return middleware.RespondError(c, fiber.StatusNotFound, "User not found")
 	}
 
-	return c.JSON(user)
+	return middleware.RespondOK(c, user)
 }
 
 func UpdateProfile(c *fiber.Ctx) error {
@@ -369,27 +544,41 @@ func UpdateProfile(c *fiber.Ctx) error {
 	id, err := strconv.ParseUint(idStr, 10, 32)
 	if err != nil {
 		// Handle invalid ID format
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid ID format",
-		})
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid ID format")
 	}
 
 	// Find the user in the database
 	var user database.User
-	if err := database.GetDB().First(&user, uint(id)).Error; err != nil {
+	if err := requestDB(c).First(&user, uint(id)).Error; err != nil {
 		// Handle database errors (e.g., no user with the given ID)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return middleware.RespondError(c, fiber.StatusNotFound, "User not found")
+	}
+
+	// Users can only update their own profile, unless they are an admin
+	callerID, allowed := canManageAccount(c, user.ID)
+	if !allowed {
+		return middleware.RespondError(c, fiber.StatusForbidden, "You can only update your own profile")
 	}
 
-	var userData database.User
+	// User.Password is never serialized, so the changes are parsed into their own struct
+	var userData struct {
+		FirstName string `json:"firstname"`
+		LastName  string `json:"lastname"`
+		Email     string `json:"email" validate:"omitempty,email"`
+		Password  string `json:"password"`
+
+		// CurrentPassword must be sent to change your own password
+		CurrentPassword string `json:"current_password"`
+	}
 
 	if err := c.BodyParser(&userData); err != nil {
-		return c.Status(400).JSON(fiber.Map{
-			"success": false,
-			"message": "Cannot parse JSON",
-		})
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Cannot parse JSON")
+	}
+
+	// Validate user input
+	userData.Email = strings.TrimSpace(userData.Email)
+	if err := validate.Struct(userData); err != nil {
+		return middleware.RespondValidationError(c, "Invalid input data", err)
 	}
 
 	// Update the user's first name if it's provided in the request
@@ -404,137 +593,378 @@ func UpdateProfile(c *fiber.Ctx) error {
 
 	// Update the user's email if it's provided in the request
 	if userData.Email != "" {
+		// Another user must not own the email already (ignoring case and aliases)
+		canonicalEmail := canonicalizeEmail(userData.Email)
+		var existing database.User
+		err := requestDB(c).Where("id <> ?", user.ID).
+			Where("canonical_email = ? OR LOWER(email) = ?", canonicalEmail, canonicalEmail).
+			First(&existing).Error
+		if err == nil {
+			return middleware.RespondError(c, fiber.StatusConflict, "Email is already in use")
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return middleware.Internal(err, "Cannot check email")
+		}
+
 		user.Email = userData.Email
+		user.CanonicalEmail = canonicalEmail
 	}
 
 	// Update the user's password if it's provided in the request
-	if len(userData.Password) > 0 {
+	passwordChanged := len(userData.Password) > 0
+	if passwordChanged {
+		// Confirm the current password, so a stolen token alone can't take over the account.
+		// Admins resetting another user's password don't know it.
+		if callerID == user.ID && bcrypt.CompareHashAndPassword(user.Password, []byte(userData.CurrentPassword)) != nil {
+			return middleware.RespondError(c, fiber.StatusForbidden, "Current password is incorrect")
+		}
+
+		// Reject passwords that are on the common password blocklist
+		common, err := isCommonPassword(userData.Password)
+		if err != nil {
+			return middleware.Internal(err, "Cannot check password")
+		}
+		if common {
+			return middleware.RespondError(c, fiber.StatusBadRequest, "This password is too common, please choose another")
+		}
+
 		// Hash the new password
 		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(userData.Password), 10)
 		if err != nil {
-			return c.Status(500).JSON(fiber.Map{
-				"success": false,
-				"message": "Cannot hash password",
-			})
+			return middleware.Internal(err, "Cannot hash password")
 		}
 		user.Password = hashedPassword
 	}
 
-	if err := database.GetDB().Save(&user).Error; err != nil {
+	if err := requestDB(c).Save(&user).Error; err != nil {
+		// Another account may have taken the email since it was checked
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return middleware.RespondError(c, fiber.StatusConflict, "Email is already in use")
+		}
 		// Handle database errors
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Cannot update user's profile",
-		})
+		return middleware.Internal(err, "Cannot update user's profile")
 	}
 
-	return c.JSON(fiber.Map{
-		"success": true,
+	// End all of the user's sessions once the password has changed
+	if passwordChanged {
+		if err := revokeSessions(requestDB(c), user.ID); err != nil {
+			return middleware.Internal(err, "Cannot update user's profile")
+		}
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
 		"message": "User profile updated successfully",
 	})
 }
 
+// Normalize a genre to trimmed title case so "horror" and " HORROR " are stored the same way
+func normalizeGenre(genre string) string {
+	words := strings.Fields(strings.ToLower(genre))
+	for i, word := range words {
+		runes := []rune(word)
+		runes[0] = unicode.ToUpper(runes[0])
+		words[i] = string(runes)
+	}
+	return strings.Join(words, " ")
+}
+
 // Create a new book
 func CreateBookHandler(c *fiber.Ctx) error {
 	var newBook database.Book
 	if err := c.BodyParser(&newBook); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid input data",
-		})
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid input data")
 	}
 
-	// Generate a random numeric book ID
-	rand.Seed(time.Now().UnixNano())
-	bookID := uint(rand.Intn(10000)) // Change the range as needed
-
-	// Set the generated ID for the new book
-	newBook.ID = bookID
+	// Ignore any client-supplied ID, the database assigns one
+	newBook.ID = 0
+	newBook.Genre = normalizeGenre(newBook.Genre)
 
 	// Save the new book to the database
-	if err := database.GetDB().Create(&newBook).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create book",
-		})
+	if err := requestDB(c).Create(&newBook).Error; err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return middleware.RespondError(c, fiber.StatusConflict, "Book already exists")
+		}
+		return middleware.Internal(err, "Failed to create book")
+	}
+	return middleware.RespondOK(c, newBook)
+}
+
+// Columns the book list can be sorted by
+var bookSortColumns = map[string]string{
+	"price":          "books.price",
+	"title":          "books.title",
+	"created_at":     "books.created_at",
+	"average_rating": "COALESCE(review_stats.average_rating, 0)",
+}
+
+// Aggregate each book's live reviews into its average rating and review count
+func reviewStatsQuery(db *gorm.DB) *gorm.DB {
+	return db.Model(&database.Review{}).
+		Select("book_id, AVG(rating) AS average_rating, COUNT(*) AS review_count").
+		Group("book_id")
+}
+
+// Fill in the average rating, rounded to one decimal, and review count of the books from a
+// single aggregate query. Books without reviews report zero for both.
+func attachReviewStats(db *gorm.DB, books []database.Book) error {
+	if len(books) == 0 {
+		return nil
+	}
+
+	ids := make([]uint, len(books))
+	for i, book := range books {
+		ids[i] = book.ID
+	}
+
+	var stats []struct {
+		BookID        uint
+		AverageRating float64
+		ReviewCount   int
+	}
+	if err := reviewStatsQuery(db).Where("book_id IN ?", ids).Scan(&stats).Error; err != nil {
+		return err
+	}
+
+	byBook := make(map[uint]int, len(stats))
+	for i, stat := range stats {
+		byBook[stat.BookID] = i
+	}
+	for i := range books {
+		books[i].AverageRating, books[i].ReviewCount = 0, 0
+		if j, ok := byBook[books[i].ID]; ok {
+			books[i].AverageRating = math.Round(stats[j].AverageRating*10) / 10
+			books[i].ReviewCount = stats[j].ReviewCount
+		}
+	}
+	return nil
+}
+
+// Build the ORDER BY clause for the book list, reporting false for an unknown sort or order.
+// Ties, and requests without a sort, fall back to ID order so pages are stable.
+func bookListOrder(sortBy, order string) (string, bool) {
+	if sortBy == "" {
+		return "books.id", order == ""
+	}
+
+	column, ok := bookSortColumns[sortBy]
+	if !ok {
+		return "", false
+	}
+
+	switch strings.ToLower(order) {
+	case "", "asc":
+		return column + " ASC, books.id", true
+	case "desc":
+		return column + " DESC, books.id", true
+	default:
+		return "", false
 	}
-	return c.JSON(newBook)
 }
 
-// Get a list of all books or a single book by ID
+// Get a page of books or a single book by ID
 func GetAllBooksHandler(c *fiber.Ctx) error {
 	id := c.Params("id")
 
 	if id == "" {
-		// No ID parameter, fetch all books
+		// No ID parameter, fetch a page of books
+		page, limit := parsePagination(c, defaultPageSize)
+
+		order, ok := bookListOrder(c.Query("sort"), c.Query("order"))
+		if !ok {
+			return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid sort, must be one of price, title, created_at, or average_rating with order asc or desc")
+		}
+
+		var total int64
+		if err := requestDB(c).Model(&database.Book{}).Count(&total).Error; err != nil {
+			return middleware.Internal(err, "Failed to fetch books")
+		}
+
+		query := requestDB(c).Preload("PriceTiers")
+		if c.Query("sort") == "average_rating" {
+			query = query.Joins("LEFT JOIN (?) AS review_stats ON review_stats.book_id = books.id", reviewStatsQuery(requestDB(c)))
+		}
+
 		var books []database.Book
-		if err := database.GetDB().Find(&books).Error; err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "Failed to fetch books",
-			})
+		if err := query.
+			Order(order).
+			Offset((page - 1) * limit).
+			Limit(limit).
+			Find(&books).Error; err != nil {
+			return middleware.Internal(err, "Failed to fetch books")
+		}
+		if err := attachReviewStats(requestDB(c), books); err != nil {
+			return middleware.Internal(err, "Failed to fetch ratings")
 		}
 		// Return books as a JSON object with a 'books' property
-		return c.JSON(fiber.Map{
+		return middleware.RespondOK(c, fiber.Map{
 			"books": books,
+			"total": total,
+			"page":  page,
+			"limit": limit,
 		})
 	}
 
 	// ID parameter is present, fetch a single book by ID
 	var book database.Book
-	if err := database.GetDB().First(&book, id).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Book not found",
-		})
+	if err := requestDB(c).Preload("PriceTiers").First(&book, id).Error; err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "Book not found")
+	}
+	books := []database.Book{book}
+	if err := attachReviewStats(requestDB(c), books); err != nil {
+		return middleware.Internal(err, "Failed to fetch ratings")
 	}
-	return c.JSON(book)
+	return middleware.RespondOK(c, books[0])
 }
 
 // Get a single book by ID
 func GetBookByIDHandler(c *fiber.Ctx) error {
 	id := c.Params("id")
 	var book database.Book
-	if err := database.GetDB().First(&book, id).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Book not found",
-		})
+	if err := requestDB(c).Preload("PriceTiers").First(&book, id).Error; err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "Book not found")
+	}
+	books := []database.Book{book}
+	if err := attachReviewStats(requestDB(c), books); err != nil {
+		return middleware.Internal(err, "Failed to fetch ratings")
 	}
-	return c.JSON(book)
+	return middleware.RespondOK(c, books[0])
 }
 
 // Update a book by ID
 func UpdateBookHandler(c *fiber.Ctx) error {
 	id := c.Params("id")
-	var updatedBook database.Book
+
+	// Only the fields present in the request are changed, so each one is a pointer
+	var updatedBook struct {
+		Title       *string              `json:"title"`
+		Author      *string              `json:"author"`
+		ISBN        *string              `json:"isbn"`
+		Genre       *string              `json:"genre"`
+		Price       *float64             `json:"price"`
+		Quantity    *int                 `json:"quantity"`
+		Description *string              `json:"description"`
+		Image       *string              `json:"image"`
+		MaxPerUser  *uint                `json:"max_per_user"`
+		PriceTiers  []database.PriceTier `json:"price_tiers"`
+	}
 	if err := c.BodyParser(&updatedBook); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid input data",
-		})
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid input data")
 	}
 
+	// A null max_per_user removes the limit, which a nil pointer alone can't tell from omitting it
+	var present map[string]json.RawMessage
+	json.Unmarshal(c.Body(), &present)
+	_, maxPerUserSent := present["max_per_user"]
+
 	// Find the book in the database
 	var book database.Book
-	if err := database.GetDB().First(&book, id).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Book not found",
-		})
+	if err := requestDB(c).First(&book, id).Error; err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "Book not found")
 	}
 
 	// Update the book's information
-	book.Title = updatedBook.Title
-	book.Author = updatedBook.Author
-	book.ISBN = updatedBook.ISBN
-	book.Genre = updatedBook.Genre
-	book.Price = updatedBook.Price
-	book.Quantity = updatedBook.Quantity
-	book.Description = updatedBook.Description
-	book.Image = updatedBook.Image
-	book.Path = updatedBook.Path
-
-	// Save the updated book to the database
-	if err := database.GetDB().Save(&book).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to update book",
+	updates := map[string]interface{}{}
+	if updatedBook.Title != nil {
+		book.Title = *updatedBook.Title
+		updates["title"] = book.Title
+	}
+	if updatedBook.Author != nil {
+		book.Author = *updatedBook.Author
+		updates["author"] = book.Author
+	}
+	if updatedBook.ISBN != nil {
+		book.ISBN = *updatedBook.ISBN
+		updates["isbn"] = book.ISBN
+	}
+	if updatedBook.Genre != nil {
+		book.Genre = normalizeGenre(*updatedBook.Genre)
+		updates["genre"] = book.Genre
+	}
+	if updatedBook.Price != nil {
+		book.Price = *updatedBook.Price
+		updates["price"] = book.Price
+	}
+	if updatedBook.Quantity != nil {
+		book.Quantity = *updatedBook.Quantity
+		updates["quantity"] = book.Quantity
+	}
+	if updatedBook.Description != nil {
+		book.Description = *updatedBook.Description
+		updates["description"] = book.Description
+	}
+	if updatedBook.Image != nil {
+		book.Image = *updatedBook.Image
+		updates["image"] = book.Image
+	}
+	if maxPerUserSent {
+		book.MaxPerUser = updatedBook.MaxPerUser
+		updates["max_per_user"] = book.MaxPerUser
+	}
+	featured := book.Featured
+	unfeatureIfOutOfStock(&book)
+	if book.Featured != featured {
+		updates["featured"] = book.Featured
+	}
+
+	// Save the changed fields to the database
+	if len(updates) > 0 {
+		if err := requestDB(c).Model(&book).Updates(updates).Error; err != nil {
+			return middleware.Internal(err, "Failed to update book")
+		}
+	}
+
+	// Replace the book's price tiers if new ones were provided
+	if updatedBook.PriceTiers != nil {
+		err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("book_id = ?", book.ID).Delete(&database.PriceTier{}).Error; err != nil {
+				return err
+			}
+			for i := range updatedBook.PriceTiers {
+				updatedBook.PriceTiers[i].ID = 0
+				updatedBook.PriceTiers[i].BookID = book.ID
+			}
+			if len(updatedBook.PriceTiers) == 0 {
+				return nil
+			}
+			return tx.Create(&updatedBook.PriceTiers).Error
 		})
+		if err != nil {
+			return middleware.Internal(err, "Failed to update price tiers")
+		}
+		book.PriceTiers = updatedBook.PriceTiers
+	}
+
+	return middleware.RespondOK(c, book)
+}
+
+// Report how many carts, reviews, and orders reference a book, to help decide how to delete it
+func GetBookDeleteImpactHandler(c *fiber.Ctx) error {
+	var book database.Book
+	if err := requestDB(c).First(&book, c.Params("id")).Error; err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "Book not found")
 	}
 
-	return c.JSON(book)
+	var carts, reviews, orders int64
+	if err := requestDB(c).Model(&database.CartItem{}).Where("book_id = ?", book.ID).Count(&carts).Error; err != nil {
+		return middleware.Internal(err, "Failed to count carts")
+	}
+	if err := requestDB(c).Model(&database.Review{}).Where("book_id = ?", book.ID).Count(&reviews).Error; err != nil {
+		return middleware.Internal(err, "Failed to count reviews")
+	}
+	if err := requestDB(c).Model(&database.OrderItem{}).
+		Joins("JOIN orders ON orders.id = order_items.order_id AND orders.deleted_at IS NULL").
+		Where("order_items.book_id = ?", book.ID).
+		Distinct("order_items.order_id").
+		Count(&orders).Error; err != nil {
+		return middleware.Internal(err, "Failed to count orders")
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
+		"book_id": book.ID,
+		"carts":   carts,
+		"reviews": reviews,
+		"orders":  orders,
+	})
 }
 
 // Delete a book by ID
@@ -543,21 +973,16 @@ func DeleteBookHandler(c *fiber.Ctx) error {
 
 	// Find the book in the database
 	var book database.Book
-	if err := database.GetDB().First(&book, id).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Book not found",
-		})
+	if err := requestDB(c).First(&book, id).Error; err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "Book not found")
 	}
 
 	// Delete the book from the database
-	if err := database.GetDB().Delete(&book).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to delete book",
-		})
+	if err := requestDB(c).Delete(&book).Error; err != nil {
+		return middleware.Internal(err, "Failed to delete book")
 	}
 
-	return c.JSON(fiber.Map{
-		"success": true,
+	return middleware.RespondOK(c, fiber.Map{
 		"message": "Book deleted successfully",
 	})
 }
@@ -565,32 +990,35 @@ func DeleteBookHandler(c *fiber.Ctx) error {
 // Get all users
 func GetAllUsersHandler(c *fiber.Ctx) error {
 	var users []database.User
-	if err := database.GetDB().Find(&users).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch users",
-		})
+	if err := requestDB(c).Find(&users).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch users")
 	}
-	return c.JSON(users)
+	return middleware.RespondOK(c, users)
 }
 
 // Get a single user by ID
 func GetUserByIDHandler(c *fiber.Ctx) error {
 	id := c.Params("id")
 	var user database.User
-	if err := database.GetDB().First(&user, id).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+	if err := requestDB(c).First(&user, id).Error; err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "User not found")
 	}
-	return c.JSON(user)
+	return middleware.RespondOK(c, user)
 }
 
-// Create JWT token
-func CreateToken(userID uint) (string, error) {
+// Create a short-lived JWT access token for a login session. The token never outlives
+// notAfter, the end of its session, unless notAfter is zero.
+func CreateToken(userID, sessionID uint, notAfter time.Time) (string, error) {
+	expiresAt := time.Now().Add(durationFromEnv("ACCESS_TOKEN_TTL", 15*time.Minute))
+	if !notAfter.IsZero() && expiresAt.After(notAfter) {
+		expiresAt = notAfter
+	}
+
 	// Define the payload
 	payload := jwt.MapClaims{}
 	payload["user_id"] = userID
-	payload["exp"] = time.Now().Add(time.Hour * 24).Unix() // 24 hours
+	payload["sid"] = sessionID
+	payload["exp"] = expiresAt.Unix()
 
 	// Create the token
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, payload)
@@ -599,428 +1027,2663 @@ func CreateToken(userID uint) (string, error) {
 	return token.SignedString([]byte(os.Getenv("JWT_SECRET")))
 }
 
-// Create a new cart item and add it to the user's cart
-func AddToCartHandler(c *fiber.Ctx) error {
-	// Parse the user ID from the JWT token
-	token := c.Locals("user").(*jwt.Token)
-	claims := token.Claims.(jwt.MapClaims)
-	userID := uint(claims["user_id"].(float64))
+// Reissue the access token of the session named in a token's claims, ending no later than the session
+func reissueToken(claims jwt.MapClaims, notAfter time.Time) (string, error) {
+	userID, _ := claims["user_id"].(float64)
+	sessionID, _ := claims["sid"].(float64)
+	return CreateToken(uint(userID), uint(sessionID), notAfter)
+}
 
-	// Parse the book ID and quantity from the request body
-	var cartItem struct {
-		BookID   uint `json:"book_id" validate:"required"`
-		Quantity uint `json:"quantity" validate:"required"`
-	}
+// Hash a refresh token for storage and lookup
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
 
-	if err := c.BodyParser(&cartItem); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid input data",
-		})
+// Start a login session, returning an access token and the refresh token that renews it
+func createSession(db *gorm.DB, userID uint) (string, string, error) {
+	random := make([]byte, 32)
+	if _, err := crand.Read(random); err != nil {
+		return "", "", err
 	}
+	refreshToken := hex.EncodeToString(random)
 
-	// Validate the input
-	if err := validate.Struct(cartItem); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error":  "Invalid input data",
-			"errors": err.(validator.ValidationErrors),
-		})
+	session := database.RefreshToken{
+		UserID:    userID,
+		TokenHash: hashRefreshToken(refreshToken),
+		ExpiresAt: time.Now().Add(durationFromEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour)),
+	}
+	if err := db.Create(&session).Error; err != nil {
+		return "", "", err
 	}
 
-	// Check if the book is already in the user's cart
-	var existingCartItem database.CartItem
-	if err := database.GetDB().Where("user_id = ? AND book_id = ?", userID, cartItem.BookID).First(&existingCartItem).Error; err == nil {
-		// Book is already in the cart, update the quantity
-		existingCartItem.Quantity += cartItem.Quantity
+	accessToken, err := CreateToken(userID, session.ID, session.ExpiresAt)
+	if err != nil {
+		return "", "", err
+	}
+	return accessToken, refreshToken, nil
+}
 
-		// Retrieve the book price
-		var book database.Book
-		if err := database.GetDB().First(&book, cartItem.BookID).Error; err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "Failed to fetch book details",
-			})
-		}
+// Revoke every active session of a user, ending their access tokens too
+func revokeSessions(db *gorm.DB, userID uint) error {
+	return db.Model(&database.RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		UpdateColumn("revoked_at", time.Now()).Error
+}
 
-		// Calculate the subtotal and assign it to the existing cart item
-		existingCartItem.Subtotal = float64(existingCartItem.Quantity) * book.Price
+// Exchange a refresh token for a new access token. The refresh token is rotated, so each one
+// can only be used once.
+func RefreshTokenHandler(c *fiber.Ctx) error {
+	var request struct {
+		RefreshToken string `json:"refresh_token" validate:"required"`
+	}
 
-		if err := database.GetDB().Save(&existingCartItem).Error; err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "Failed to update cart",
-			})
-		}
-		return c.JSON(existingCartItem)
+	if err := c.BodyParser(&request); err != nil {
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid input data")
 	}
 
-	// Book is not in the cart, create a new cart item
-	newCartItem := database.CartItem{
-		UserID:   userID,
-		BookID:   cartItem.BookID,
-		Quantity: cartItem.Quantity,
+	// Validate the input
+	if err := validate.Struct(request); err != nil {
+		return middleware.RespondValidationError(c, "Invalid input data", err)
 	}
 
-	// Retrieve the book price
-	var book database.Book
-	if err := database.GetDB().First(&book, cartItem.BookID).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch book details",
-		})
+	var session database.RefreshToken
+	if err := requestDB(c).Where("token_hash = ?", hashRefreshToken(request.RefreshToken)).First(&session).Error; err != nil {
+		return middleware.RespondError(c, fiber.StatusUnauthorized, "Invalid refresh token")
+	}
+	if session.RevokedAt != nil {
+		return middleware.RespondError(c, fiber.StatusUnauthorized, "Refresh token has been revoked")
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return middleware.RespondError(c, fiber.StatusUnauthorized, "Refresh token has expired")
 	}
 
-	// Calculate the subtotal and assign it to the new cart item
-	newCartItem.Subtotal = float64(newCartItem.Quantity) * book.Price
+	var accessToken, refreshToken string
+	revoked := false
+	err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+		// Only one request can use the token, even if several arrive at once
+		result := tx.Model(&database.RefreshToken{}).
+			Where("id = ? AND revoked_at IS NULL", session.ID).
+			UpdateColumn("revoked_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			revoked = true
+			return nil
+		}
 
-	if err := database.GetDB().Create(&newCartItem).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to add to cart",
-		})
+		var err error
+		accessToken, refreshToken, err = createSession(tx, session.UserID)
+		return err
+	})
+	if err != nil {
+		return middleware.Internal(err, "Cannot refresh token")
+	}
+	if revoked {
+		return middleware.RespondError(c, fiber.StatusUnauthorized, "Refresh token has been revoked")
 	}
 
-	return c.JSON(newCartItem)
-}
+	// Refreshing counts as activity, so the account isn't deactivated for inactivity
+	if err := requestDB(c).Model(&database.User{}).Where("id = ?", session.UserID).
+		UpdateColumn("last_login_at", time.Now()).Error; err != nil {
+		log.Printf("Failed to record refresh for user %d: %v", session.UserID, err)
+	}
 
-// Get the user's cart items
-func GetCartHandler(c *fiber.Ctx) error {
-	// Parse the user ID from the JWT token
-	token := c.Locals("user").(*jwt.Token)
-	claims := token.Claims.(jwt.MapClaims)
-	userID := uint(claims["user_id"].(float64))
+	return middleware.RespondOK(c, fiber.Map{
+		"token":         accessToken,
+		"refresh_token": refreshToken,
+	})
+}
 
-	// Find all cart items for the user
-	var cartItems []database.CartItem
-	if err := database.GetDB().Where("user_id = ?", userID).Find(&cartItems).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch cart items",
-		})
+// How the price of a cart line is derived
+type linePrice struct {
+	UnitPrice           float64 `json:"unit_price"`
+	Quantity            uint    `json:"quantity"`
+	BasePrice           float64 `json:"base_price"`
+	TierDiscountPercent float64 `json:"tier_discount_percent"`
+	TierDiscount        float64 `json:"tier_discount"`
+	Subtotal            float64 `json:"subtotal"`
+}
+
+// Price a cart line, applying the best price tier the quantity qualifies for
+func calculateLinePrice(book database.Book, quantity uint) linePrice {
+	discount := 0.0
+	for _, tier := range book.PriceTiers {
+		if quantity >= tier.MinQuantity && tier.DiscountPercent > discount {
+			discount = tier.DiscountPercent
+		}
 	}
 
-	if len(cartItems) == 0 {
-		return c.JSON(fiber.Map{
-			"message": "Cart is empty",
-		})
+	base := float64(quantity) * book.Price
+	subtotal := math.Round(base*(1-discount/100)*100) / 100
+	return linePrice{
+		UnitPrice:           book.Price,
+		Quantity:            quantity,
+		BasePrice:           math.Round(base*100) / 100,
+		TierDiscountPercent: discount,
+		TierDiscount:        math.Round((base-subtotal)*100) / 100,
+		Subtotal:            subtotal,
 	}
+}
 
-	// Return the cart items
-	return c.JSON(cartItems)
+// Calculate the subtotal of a cart line
+func calculateSubtotal(book database.Book, quantity uint) float64 {
+	return calculateLinePrice(book, quantity).Subtotal
 }
 
-// Remove an item from the user's cart
-func RemoveFromCartHandler(c *fiber.Ctx) error {
+// Create a new cart item and add it to the user's cart
+func AddToCartHandler(c *fiber.Ctx) error {
 	// Parse the user ID from the JWT token
 	token := c.Locals("user").(*jwt.Token)
 	claims := token.Claims.(jwt.MapClaims)
 	userID := uint(claims["user_id"].(float64))
 
-	// Parse the book ID from the URL parameter
-	bookID := c.Params("book_id")
+	// Parse the book ID and quantity from the request body
+	var cartItem struct {
+		BookID   uint `json:"book_id" validate:"required"`
+		Quantity uint `json:"quantity" validate:"required"`
+	}
 
-	// Find the cart item to remove
-	var cartItem database.CartItem
-	if err := database.GetDB().Where("user_id = ? AND book_id = ?", userID, bookID).First(&cartItem).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Cart item not found",
-		})
+	if err := c.BodyParser(&cartItem); err != nil {
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid input data")
 	}
 
-	// Delete the cart item
-	if err := database.GetDB().Delete(&cartItem).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to remove item from cart",
-		})
+	// Validate the input
+	if err := validate.Struct(cartItem); err != nil {
+		return middleware.RespondValidationError(c, "Invalid input data", err)
 	}
 
-	return c.JSON(fiber.Map{
-		"success": true,
-		"message": "Item removed from cart",
+	var item database.CartItem
+	err := retryDuplicateCartItem(func() error {
+		return requestDB(c).Transaction(func(tx *gorm.DB) error {
+			var err error
+			item, err = addCartItem(tx, userID, cartItem.BookID, cartItem.Quantity)
+			return err
+		})
 	})
+
+	var limitErr *purchaseLimitError
+	var stockErr *insufficientStockError
+	switch {
+	case err == nil:
+		return middleware.RespondOK(c, item)
+	case errors.As(err, &limitErr):
+		return purchaseLimitExceeded(c, limitErr.Book, limitErr.Purchased)
+	case errors.As(err, &stockErr):
+		return stockExceeded(c, stockErr.Book)
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return middleware.RespondError(c, fiber.StatusNotFound, "Book not found")
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return middleware.RespondError(c, fiber.StatusConflict, "Your cart was changed by another request, please try again")
+	default:
+		return middleware.Internal(err, "Failed to add to cart")
+	}
 }
 
-// Update the quantity of a cart item
-func UpdateCartItemQuantityHandler(c *fiber.Ctx) error {
+// Run a cart add, retrying it once if a concurrent first add of the same book committed first
+// and the cart's unique index rejected this insert. The retry merges into the row the other
+// request created. gorm.ErrDuplicatedKey is returned if the retry fails the same way.
+func retryDuplicateCartItem(add func() error) error {
+	err := add()
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		err = add()
+	}
+	return err
+}
+
+// Most items a single bulk cart add may contain
+const maxBulkCartItems = 100
+
+// bulkCartResult reports whether one item of a bulk cart add made it into the cart
+type bulkCartResult struct {
+	BookID   uint               `json:"book_id"`
+	Quantity uint               `json:"quantity"`
+	Success  bool               `json:"success"`
+	Error    string             `json:"error,omitempty"`
+	Item     *database.CartItem `json:"item,omitempty"`
+}
+
+// Add several books to the user's cart in one transaction. Each item is checked like a single
+// add; an item that fails is reported and skipped while the others are still added.
+func BulkAddToCartHandler(c *fiber.Ctx) error {
 	// Parse the user ID from the JWT token
 	token := c.Locals("user").(*jwt.Token)
 	claims := token.Claims.(jwt.MapClaims)
 	userID := uint(claims["user_id"].(float64))
 
-	// Parse the book ID from the URL parameter
-	bookID := c.Params("book_id")
-
-	// Parse the new quantity from the request body
-	var update struct {
-		Quantity uint `json:"quantity" validate:"required"`
+	var request struct {
+		Items []struct {
+			BookID   uint `json:"book_id" validate:"required"`
+			Quantity uint `json:"quantity" validate:"required"`
+		} `json:"items" validate:"required,min=1,max=100,dive"`
 	}
 
-	if err := c.BodyParser(&update); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid input data",
-		})
+	if err := c.BodyParser(&request); err != nil {
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid input data")
 	}
 
 	// Validate the input
-	if err := validate.Struct(update); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error":  "Invalid input data",
-			"errors": err.(validator.ValidationErrors),
-		})
+	if err := validate.Struct(request); err != nil {
+		return middleware.RespondValidationError(c, fmt.Sprintf("Provide between 1 and %d items with a book_id and quantity", maxBulkCartItems), err)
+	}
+
+	results := make([]bulkCartResult, len(request.Items))
+	added := 0
+	err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+		for i, requested := range request.Items {
+			result := bulkCartResult{BookID: requested.BookID, Quantity: requested.Quantity}
+
+			// Each item runs in a nested transaction (a savepoint) so a failure only undoes that item
+			err := retryDuplicateCartItem(func() error {
+				return tx.Transaction(func(tx *gorm.DB) error {
+					item, err := addCartItem(tx, userID, requested.BookID, requested.Quantity)
+					if err != nil {
+						return err
+					}
+					result.Item = &item
+					return nil
+				})
+			})
+
+			var limitErr *purchaseLimitError
+			var stockErr *insufficientStockError
+			switch {
+			case err == nil:
+				result.Success = true
+				added++
+			case errors.As(err, &limitErr):
+				result.Error = fmt.Sprintf("You can buy at most %d copies of this book", *limitErr.Book.MaxPerUser)
+			case errors.As(err, &stockErr):
+				result.Error = fmt.Sprintf("Only %d copies available", max(stockErr.Book.Quantity, 0))
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				result.Error = "Book not found"
+			case errors.Is(err, gorm.ErrDuplicatedKey):
+				// A concurrent request added the same book first, even on the retry
+				result.Error = "Your cart was changed by another request, please try again"
+			default:
+				log.Printf("Failed to add book %d to cart for user %d: %v", requested.BookID, userID, err)
+				result.Error = "Failed to add to cart"
+			}
+			results[i] = result
+		}
+		return nil
+	})
+	if err != nil {
+		return middleware.Internal(err, "Failed to add to cart")
 	}
 
-	// Find the cart item to update
-	var cartItem database.CartItem
-	if err := database.GetDB().Where("user_id = ? AND book_id = ?", userID, bookID).First(&cartItem).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Cart item not found",
-		})
+	return middleware.RespondOK(c, fiber.Map{
+		"added":   added,
+		"failed":  len(results) - added,
+		"results": results,
+	})
+}
+
+// Add copies of a book to the user's cart within tx, merging with an existing line. Returns
+// gorm.ErrRecordNotFound for a missing book, a purchaseLimitError or insufficientStockError
+// when the book can't be added, and gorm.ErrDuplicatedKey when a concurrent request inserted
+// the line first.
+func addCartItem(tx *gorm.DB, userID, bookID, quantity uint) (database.CartItem, error) {
+	var book database.Book
+	if err := tx.Preload("PriceTiers").First(&book, bookID).Error; err != nil {
+		return database.CartItem{}, err
 	}
 
-	// Update the quantity
-	cartItem.Quantity = update.Quantity
-	if err := database.GetDB().Save(&cartItem).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to update cart item quantity",
-		})
+	var existing database.CartItem
+	err := tx.Where("user_id = ? AND book_id = ?", userID, bookID).First(&existing).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return database.CartItem{}, err
 	}
+	inCart := err == nil
 
-	return c.JSON(cartItem)
-}
+	// Enforce the book's per-user purchase limit across past orders and the cart
+	if book.MaxPerUser != nil {
+		purchased, err := purchasedQuantity(tx, userID, book.ID)
+		if err != nil {
+			return database.CartItem{}, err
+		}
+		if purchased+existing.Quantity+quantity > *book.MaxPerUser {
+			return database.CartItem{}, &purchaseLimitError{Book: book, Purchased: purchased + existing.Quantity}
+		}
+	}
 
-// Add a review for a book
-func AddReviewHandler(c *fiber.Ctx) error {
-	// Parse the book ID from the URL parameter
-	bookIDStr := c.Params("book_id")
+	// Make sure there is enough stock for the combined quantity
+	if insufficientStock(book, existing.Quantity+quantity) {
+		return database.CartItem{}, &insufficientStockError{Book: book}
+	}
 
-	// Convert the book ID to a uint
-	bookID, err := strconv.ParseUint(bookIDStr, 10, 32)
-	if err != nil {
-		// Handle invalid ID format
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid ID format",
-		})
+	if inCart {
+		return incrementCartItem(tx, existing.ID, book, quantity)
 	}
 
-	// Convert the book ID to a uint
-	bookIDUint := uint(bookID)
+	item := database.CartItem{
+		UserID:   userID,
+		BookID:   bookID,
+		Quantity: quantity,
+		Subtotal: calculateSubtotal(book, quantity),
+	}
+	return item, tx.Create(&item).Error
+}
 
+// Remove every item from the user's cart
+func ClearCartHandler(c *fiber.Ctx) error {
 	// Parse the user ID from the JWT token
 	token := c.Locals("user").(*jwt.Token)
 	claims := token.Claims.(jwt.MapClaims)
 	userID := uint(claims["user_id"].(float64))
 
-	// Check if the user has already reviewed the book
-	var existingReview database.Review
-	if err := database.GetDB().Where("user_id = ? AND book_id = ?", userID, bookIDUint).First(&existingReview).Error; err == nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "You have already reviewed this book",
-		})
+	result := requestDB(c).Where("user_id = ?", userID).Delete(&database.CartItem{})
+	if result.Error != nil {
+		return middleware.Internal(result.Error, "Failed to clear cart")
 	}
 
-	// Check if the book exists
-	var book database.Book
-	if err := database.GetDB().First(&book, bookIDUint).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Book not found",
-		})
-	}
+	return middleware.RespondOK(c, fiber.Map{
+		"removed": result.RowsAffected,
+	})
+}
 
-	// Check if the user exists
-	var user database.User
-	if err := database.GetDB().First(&user, userID).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
-	}
+// Atomically add to a cart item's quantity and reprice it for the new total
+func incrementCartItem(db *gorm.DB, id uint, book database.Book, quantity uint) (database.CartItem, error) {
+	var item database.CartItem
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&database.CartItem{}).Where("id = ?", id).
+			UpdateColumn("quantity", gorm.Expr("quantity + ?", quantity)).Error; err != nil {
+			return err
+		}
+		if err := tx.First(&item, id).Error; err != nil {
+			return err
+		}
+		item.Subtotal = calculateSubtotal(book, item.Quantity)
+		return tx.Model(&item).Update("subtotal", item.Subtotal).Error
+	})
+	return item, err
+}
 
-	// Parse the review data from the request body
-	var review database.Review
-	if err := c.BodyParser(&review); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid input data",
-		})
-	}
+// Count how many copies of a book the user has bought in completed or pre-ordered orders
+func purchasedQuantity(db *gorm.DB, userID, bookID uint) (uint, error) {
+	var purchased uint
+	err := db.Model(&database.OrderItem{}).
+		Select("COALESCE(SUM(order_items.quantity), 0)").
+		Joins("JOIN orders ON orders.id = order_items.order_id AND orders.deleted_at IS NULL").
+		Where("orders.user_id = ? AND orders.status IN ? AND order_items.book_id = ?", userID, []database.OrderStatus{database.OrderStatusCompleted, database.OrderStatusPreOrdered}, bookID).
+		Scan(&purchased).Error
+	return purchased, err
+}
 
-	// Set the book ID and user ID
-	review.BookID = bookIDUint
-	review.UserID = userID
+// Report whether the user has a completed order line for the book. Pre-ordered lines don't count
+// until the book is released and releasePreOrders completes them.
+func hasCompletedPurchase(db *gorm.DB, userID, bookID uint) (bool, error) {
+	var count int64
+	err := db.Model(&database.OrderItem{}).
+		Joins("JOIN orders ON orders.id = order_items.order_id AND orders.deleted_at IS NULL").
+		Where("orders.user_id = ? AND order_items.book_id = ? AND order_items.status = ?", userID, bookID, database.OrderStatusCompleted).
+		Where("orders.status IN ?", []database.OrderStatus{database.OrderStatusCompleted, database.OrderStatusPreOrdered}).
+		Count(&count).Error
+	return count > 0, err
+}
 
-	// Save the review to the database
-	if err := database.GetDB().Create(&review).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to add review",
-		})
+// Reject a cart change that would take the user past the book's MaxPerUser, reporting how many
+// more copies they could still add on top of the held quantity
+func purchaseLimitExceeded(c *fiber.Ctx, book database.Book, held uint) error {
+	var remaining uint
+	if held < *book.MaxPerUser {
+		remaining = *book.MaxPerUser - held
 	}
+	return middleware.RespondErrorData(c, fiber.StatusBadRequest, fmt.Sprintf("You can buy at most %d copies of this book", *book.MaxPerUser), fiber.Map{
+		"remaining": remaining,
+	})
+}
 
-	// Fetch the review again from the database to get the created_at value
-	if err := database.GetDB().Where("id = ?", review.ID).First(&review).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch review",
-		})
-	}
+// Report whether the book has fewer copies in stock than requested. Unreleased pre-orders
+// can be carted and bought before any stock arrives.
+func insufficientStock(book database.Book, quantity uint) bool {
+	return !book.IsUnreleasedPreOrder() && int(quantity) > book.Quantity
+}
 
-	return c.JSON(review)
+// Reject a cart change that asks for more copies than are in stock
+func stockExceeded(c *fiber.Ctx, book database.Book) error {
+	return middleware.RespondError(c, fiber.StatusBadRequest, fmt.Sprintf("Only %d copies available", max(book.Quantity, 0)))
 }
 
-// Get reviews for a book with user names
-func GetBookReviewsHandler(c *fiber.Ctx) error {
-	// Parse the book ID from the URL parameter
-	bookID := c.Params("book_id")
+// Get the user's cart items
+func GetCartHandler(c *fiber.Ctx) error {
+	// Parse the user ID from the JWT token
+	token := c.Locals("user").(*jwt.Token)
+	claims := token.Claims.(jwt.MapClaims)
+	userID := uint(claims["user_id"].(float64))
 
-	// Find all reviews for the book and include user information
-	var reviews []struct {
-		database.Review
-		FirstName string `json:"first_name"`
-		CreatedAt string `json:"created_at"`
+	// Find all cart items for the user
+	var cartItems []database.CartItem
+	if err := requestDB(c).Where("user_id = ?", userID).Find(&cartItems).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch cart items")
 	}
-	if err := database.GetDB().Table("reviews").
-		Select("reviews.*, users.first_name, reviews.created_at").
-		Joins("LEFT JOIN users ON users.id = reviews.user_id").
-		Where("reviews.book_id = ?", bookID).
-		Scan(&reviews).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch reviews",
+
+	if len(cartItems) == 0 {
+		return middleware.RespondOK(c, fiber.Map{
+			"message": "Cart is empty",
 		})
 	}
 
-	if len(reviews) == 0 {
-		return c.JSON(fiber.Map{
-			"message": "No reviews for this book",
-		})
+	// Optionally recompute the subtotals from the books' current prices
+	if err := refreshCartPrices(requestDB(c), cartItems); err != nil {
+		return middleware.Internal(err, "Failed to refresh cart prices")
 	}
 
-	// Return the reviews with user first names and CreatedAt
-	return c.JSON(reviews)
+	// Return the cart items
+	return middleware.RespondOK(c, cartItems)
 }
 
-func DownloadBookHandler(c *fiber.Ctx) error {
-	// Parse the book ID from the URL parameter
-	bookID := c.Params("id")
+// Recompute the cart items' subtotals from current prices according to CART_PRICE_REFRESH.
+// By default ("off") the stored subtotals are returned as they are. With "read" the
+// response reflects live prices, and with "persist" the new subtotals are also saved.
+// Items whose subtotal changed are flagged with PriceChanged.
+func refreshCartPrices(db *gorm.DB, items []database.CartItem) error {
+	mode := strings.ToLower(os.Getenv("CART_PRICE_REFRESH"))
+	if mode != "read" && mode != "persist" {
+		return nil
+	}
 
-	// Find the book in the database by ID
-	var book database.Book
-	if err := database.GetDB().First(&book, bookID).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Book not found",
-		})
+	ids := make([]uint, len(items))
+	for i, item := range items {
+		ids[i] = item.BookID
 	}
+	var books []database.Book
+	if err := db.Preload("PriceTiers").Where("id IN ?", ids).Find(&books).Error; err != nil {
+		return err
+	}
+	booksByID := make(map[uint]database.Book, len(books))
+	for _, book := range books {
+		booksByID[book.ID] = book
+	}
+
+	for i := range items {
+		book, ok := booksByID[items[i].BookID]
+		if !ok {
+			// The book is gone, keep the last known subtotal
+			continue
+		}
+		subtotal := calculateSubtotal(book, items[i].Quantity)
+		if subtotal == items[i].Subtotal {
+			continue
+		}
+		items[i].Subtotal = subtotal
+		items[i].PriceChanged = true
 
-	// Get the file path
-	filePath := book.Path
+		if mode == "persist" {
+			if err := db.Model(&items[i]).UpdateColumn("subtotal", subtotal).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-	// send the file path as a response
-	return c.JSON(fiber.Map{
-		"file_path": filePath,
-	})
+// cartTotalItem is one line of the cart summary, priced at the book's current price
+type cartTotalItem struct {
+	BookID         uint      `json:"book_id"`
+	Title          string    `json:"title"`
+	Price          linePrice `json:"price"`
+	StoredSubtotal float64   `json:"stored_subtotal"`
+	Stale          bool      `json:"stale"`
+	BookDeleted    bool      `json:"book_deleted"`
+	OutOfStock     bool      `json:"out_of_stock"`
 }
 
-// Cart section for admin to see all the users cart items
-func GetAllCartItemsHandler(c *fiber.Ctx) error {
+// Get the user's cart priced at current prices, with the grand total and item count. Items whose
+// stored subtotal is stale, whose book was deleted, or that are out of stock are flagged.
+// Deleted books can't be bought, so they are left out of the total.
+func GetCartTotalHandler(c *fiber.Ctx) error {
+	// Parse the user ID from the JWT token
+	token := c.Locals("user").(*jwt.Token)
+	claims := token.Claims.(jwt.MapClaims)
+	userID := uint(claims["user_id"].(float64))
+
 	var cartItems []database.CartItem
-	if err := database.GetDB().Find(&cartItems).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch cart items",
-		})
+	if err := requestDB(c).Where("user_id = ?", userID).Order("id").Find(&cartItems).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch cart items")
 	}
 
-	if len(cartItems) == 0 {
-		return c.JSON(fiber.Map{
-			"message": "Cart is empty",
-		})
+	ids := make([]uint, len(cartItems))
+	for i, item := range cartItems {
+		ids[i] = item.BookID
+	}
+	var books []database.Book
+	if len(ids) > 0 {
+		if err := requestDB(c).Unscoped().Preload("PriceTiers").Where("id IN ?", ids).Find(&books).Error; err != nil {
+			return middleware.Internal(err, "Failed to fetch book details")
+		}
+	}
+	booksByID := make(map[uint]database.Book, len(books))
+	for _, book := range books {
+		booksByID[book.ID] = book
 	}
 
-	// Return the cart items
-	return c.JSON(cartItems)
+	items := make([]cartTotalItem, 0, len(cartItems))
+	var total float64
+	var itemCount uint
+	for _, cartItem := range cartItems {
+		item := cartTotalItem{
+			BookID:         cartItem.BookID,
+			StoredSubtotal: cartItem.Subtotal,
+			Price:          linePrice{Quantity: cartItem.Quantity},
+		}
+
+		book, ok := booksByID[cartItem.BookID]
+		if !ok || book.DeletedAt.Valid {
+			item.Title = book.Title
+			item.BookDeleted = true
+			items = append(items, item)
+			continue
+		}
+
+		item.Title = book.Title
+		item.Price = calculateLinePrice(book, cartItem.Quantity)
+		item.Stale = item.Price.Subtotal != cartItem.Subtotal
+		item.OutOfStock = insufficientStock(book, cartItem.Quantity)
+		items = append(items, item)
+
+		total += item.Price.Subtotal
+		itemCount += cartItem.Quantity
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
+		"items":      items,
+		"total":      total,
+		"item_count": itemCount,
+	})
 }
 
-// Get a user's cart items
-func GetUserCartHandler(c *fiber.Ctx) error {
-	// Parse the user ID from the URL parameter
-	userID := c.Params("user_id")
+// Get how the price of one item in the user's cart is derived, at the book's current price
+func GetCartItemPriceHandler(c *fiber.Ctx) error {
+	// Parse the user ID from the JWT token
+	token := c.Locals("user").(*jwt.Token)
+	claims := token.Claims.(jwt.MapClaims)
+	userID := uint(claims["user_id"].(float64))
 
-	// Find all cart items for the user
-	var cartItems []database.CartItem
-	if err := database.GetDB().Where("user_id = ?", userID).Find(&cartItems).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch cart items",
-		})
+	// Find the cart item
+	var cartItem database.CartItem
+	if err := requestDB(c).Where("user_id = ? AND book_id = ?", userID, c.Params("book_id")).First(&cartItem).Error; err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "Cart item not found")
 	}
 
-	if len(cartItems) == 0 {
-		return c.JSON(fiber.Map{
-			"message": "Cart is empty",
-		})
+	var book database.Book
+	if err := requestDB(c).Preload("PriceTiers").First(&book, cartItem.BookID).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch book details")
 	}
 
-	// Return the cart items
-	return c.JSON(cartItems)
+	return middleware.RespondOK(c, fiber.Map{
+		"book_id": book.ID,
+		"price":   calculateLinePrice(book, cartItem.Quantity),
+	})
 }
 
 // Remove an item from the user's cart
-func DeleteCartItemHandler(c *fiber.Ctx) error {
-	// Parse the user ID from the URL parameter
-	userID := c.Params("user_id")
+func RemoveFromCartHandler(c *fiber.Ctx) error {
+	// Parse the user ID from the JWT token
+	token := c.Locals("user").(*jwt.Token)
+	claims := token.Claims.(jwt.MapClaims)
+	userID := uint(claims["user_id"].(float64))
 
 	// Parse the book ID from the URL parameter
 	bookID := c.Params("book_id")
 
 	// Find the cart item to remove
 	var cartItem database.CartItem
-	if err := database.GetDB().Where("user_id = ? AND book_id = ?", userID, bookID).First(&cartItem).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Cart item not found",
-		})
+	if err := requestDB(c).Where("user_id = ? AND book_id = ?", userID, bookID).First(&cartItem).Error; err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "Cart item not found")
 	}
 
 	// Delete the cart item
-	if err := database.GetDB().Delete(&cartItem).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to remove item from cart",
-		})
+	if err := requestDB(c).Delete(&cartItem).Error; err != nil {
+		return middleware.Internal(err, "Failed to remove item from cart")
 	}
 
-	return c.JSON(fiber.Map{
-		"success": true,
+	return middleware.RespondOK(c, fiber.Map{
 		"message": "Item removed from cart",
 	})
 }
 
-// Get the role of the user from the database
-func GetUserRoleHandler(c *fiber.Ctx) error {
-	// Parse the user ID from the URL parameter
-	userID := c.Params("id")
+// Update the quantity of a cart item
+func UpdateCartItemQuantityHandler(c *fiber.Ctx) error {
+	// Parse the user ID from the JWT token
+	token := c.Locals("user").(*jwt.Token)
+	claims := token.Claims.(jwt.MapClaims)
+	userID := uint(claims["user_id"].(float64))
 
-	// Find the user in the database
-	var user database.User
-	if err := database.GetDB().First(&user, userID).Error; err != nil {
-		// Handle database errors (e.g., no user with the given ID)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+	// Parse the book ID from the URL parameter
+	bookID := c.Params("book_id")
+
+	// Parse the new quantity from the request body
+	var update struct {
+		Quantity uint `json:"quantity" validate:"required"`
 	}
-	return c.JSON(fiber.Map{
-		"role": user.Role,
-	})
-}
 
-// Delete user handler
-func DeleteUserHandler(c *fiber.Ctx) error {
-	// Parse the user ID from the URL parameter
-	userID := c.Params("id")
+	if err := c.BodyParser(&update); err != nil {
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid input data")
+	}
 
-	// Find the user in the database
-	var user database.User
-	if err := database.GetDB().First(&user, userID).Error; err != nil {
-		// Handle database errors (e.g., no user with the given ID)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+	// Validate the input
+	if err := validate.Struct(update); err != nil {
+		return middleware.RespondValidationError(c, "Invalid input data", err)
 	}
 
-	// Delete the user from the database
-	if err := database.GetDB().Delete(&user).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to delete user",
-		})
+	// Find the cart item to update
+	var cartItem database.CartItem
+	if err := requestDB(c).Where("user_id = ? AND book_id = ?", userID, bookID).First(&cartItem).Error; err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "Cart item not found")
 	}
 
-	return c.JSON(fiber.Map{
-		"success": true,
-		"message": "User deleted successfully",
+	// Retrieve the book price
+	var book database.Book
+	if err := requestDB(c).Preload("PriceTiers").First(&book, cartItem.BookID).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch book details")
+	}
+
+	// Enforce the book's per-user purchase limit across past orders and the cart
+	if book.MaxPerUser != nil {
+		purchased, err := purchasedQuantity(requestDB(c), userID, book.ID)
+		if err != nil {
+			return middleware.Internal(err, "Failed to check purchase limit")
+		}
+		if purchased+update.Quantity > *book.MaxPerUser {
+			return purchaseLimitExceeded(c, book, purchased)
+		}
+	}
+
+	// Make sure there is enough stock
+	if insufficientStock(book, update.Quantity) {
+		return stockExceeded(c, book)
+	}
+
+	// Update the quantity and recalculate the subtotal
+	cartItem.Quantity = update.Quantity
+	cartItem.Subtotal = calculateSubtotal(book, cartItem.Quantity)
+	if err := requestDB(c).Save(&cartItem).Error; err != nil {
+		return middleware.Internal(err, "Failed to update cart item quantity")
+	}
+
+	return middleware.RespondOK(c, cartItem)
+}
+
+var errCartEmpty = errors.New("cart is empty")
+
+// A cart item asked for more copies of a book than are in stock
+type insufficientStockError struct {
+	Book database.Book
+}
+
+func (e *insufficientStockError) Error() string {
+	return fmt.Sprintf("only %d copies of book %d available", e.Book.Quantity, e.Book.ID)
+}
+
+// purchaseLimitError reports a cart line that would take the user past the book's MaxPerUser.
+// Purchased is how many copies the user already holds: those bought, and for a cart add also
+// those already in the cart.
+type purchaseLimitError struct {
+	Book      database.Book
+	Purchased uint
+}
+
+func (e *purchaseLimitError) Error() string {
+	return fmt.Sprintf("book %d is limited to %d copies per user", e.Book.ID, *e.Book.MaxPerUser)
+}
+
+// Buy everything in the user's cart inside tx: lock each book, check its purchase limit and
+// take its stock, and clear the cart. Returns the order lines priced at the current price and
+// their total, or an insufficientStockError or purchaseLimitError for the first book that
+// can't be bought, in which case the caller should roll back.
+func checkoutCart(tx *gorm.DB, userID uint) ([]database.OrderItem, float64, error) {
+	var cartItems []database.CartItem
+	if err := tx.Where("user_id = ?", userID).Order("id").Find(&cartItems).Error; err != nil {
+		return nil, 0, err
+	}
+	if len(cartItems) == 0 {
+		return nil, 0, errCartEmpty
+	}
+
+	var items []database.OrderItem
+	var total float64
+	for _, cartItem := range cartItems {
+		// Lock the book row so concurrent checkouts can't both take the last copy
+		var book database.Book
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&book, cartItem.BookID).Error; err != nil {
+			return nil, 0, err
+		}
+		if err := tx.Where("book_id = ?", book.ID).Find(&book.PriceTiers).Error; err != nil {
+			return nil, 0, err
+		}
+
+		if insufficientStock(book, cartItem.Quantity) {
+			return nil, 0, &insufficientStockError{Book: book}
+		}
+
+		// Check the limit again under the lock, since it may have been lowered after the book
+		// was carted or another checkout may have bought copies since
+		if book.MaxPerUser != nil {
+			purchased, err := purchasedQuantity(tx, userID, book.ID)
+			if err != nil {
+				return nil, 0, err
+			}
+			if purchased+cartItem.Quantity > *book.MaxPerUser {
+				return nil, 0, &purchaseLimitError{Book: book, Purchased: purchased}
+			}
+		}
+
+		// Unreleased pre-orders are sold ahead of stock, so there is nothing to take yet
+		if !book.IsUnreleasedPreOrder() {
+			book.Quantity -= int(cartItem.Quantity)
+			unfeatureIfOutOfStock(&book)
+			if err := tx.Model(&book).UpdateColumns(map[string]interface{}{
+				"quantity": book.Quantity,
+				"featured": book.Featured,
+			}).Error; err != nil {
+				return nil, 0, err
+			}
+		}
+
+		// Charge the current price, which may have changed since the item was carted
+		item := database.OrderItem{
+			BookID:    book.ID,
+			Title:     book.Title,
+			Quantity:  cartItem.Quantity,
+			UnitPrice: book.Price,
+			Subtotal:  calculateSubtotal(book, cartItem.Quantity),
+			Status:    database.OrderStatusCompleted,
+		}
+		if book.IsUnreleasedPreOrder() {
+			item.Status = database.OrderStatusPreOrdered
+		}
+		items = append(items, item)
+		total += item.Subtotal
+	}
+
+	if err := tx.Delete(&cartItems).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return items, math.Round(total*100) / 100, nil
+}
+
+// Take the stock for pre-ordered items of books that have been released, either because the
+// release date has passed or the pre-order flag was cleared. The items are completed, and so is
+// each order once none of its items are still pre-ordered. Stock can go negative when more
+// copies were pre-ordered than have arrived. Returns how many items were released.
+func releasePreOrders(db *gorm.DB, now time.Time) (int64, error) {
+	var bookIDs []uint
+	if err := db.Model(&database.OrderItem{}).
+		Joins("JOIN books ON books.id = order_items.book_id").
+		Where("order_items.status = ?", database.OrderStatusPreOrdered).
+		Where("NOT books.pre_order OR (books.release_date IS NOT NULL AND books.release_date <= ?)", now).
+		Distinct().
+		Pluck("order_items.book_id", &bookIDs).Error; err != nil {
+		return 0, err
+	}
+
+	var released int64
+	for _, bookID := range bookIDs {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			// Lock the book row so checkouts and other releases see the new stock
+			var book database.Book
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&book, bookID).Error; err != nil {
+				return err
+			}
+
+			var items []database.OrderItem
+			if err := tx.Where("book_id = ? AND status = ?", bookID, database.OrderStatusPreOrdered).Find(&items).Error; err != nil {
+				return err
+			}
+			if len(items) == 0 {
+				return nil
+			}
+
+			ids := make([]uint, len(items))
+			orderIDs := make([]uint, len(items))
+			for i, item := range items {
+				ids[i], orderIDs[i] = item.ID, item.OrderID
+				book.Quantity -= int(item.Quantity)
+			}
+			unfeatureIfOutOfStock(&book)
+			if err := tx.Model(&book).UpdateColumns(map[string]interface{}{
+				"quantity": book.Quantity,
+				"featured": book.Featured,
+			}).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Model(&database.OrderItem{}).Where("id IN ?", ids).
+				Update("status", database.OrderStatusCompleted).Error; err != nil {
+				return err
+			}
+			released += int64(len(items))
+
+			// Complete the orders that have nothing left waiting for release
+			return tx.Model(&database.Order{}).
+				Where("id IN ? AND status = ?", orderIDs, database.OrderStatusPreOrdered).
+				Where("NOT EXISTS (SELECT 1 FROM order_items WHERE order_items.order_id = orders.id AND order_items.status = ?)", database.OrderStatusPreOrdered).
+				Update("status", database.OrderStatusCompleted).Error
+		})
+		if err != nil {
+			return released, err
+		}
+	}
+	return released, nil
+}
+
+// StartPreOrderReleaseJob releases pre-orders of newly released books, checking once per interval
+func StartPreOrderReleaseJob(interval time.Duration) {
+	for {
+		count, err := releasePreOrders(database.GetDB(), time.Now())
+		if err != nil {
+			log.Printf("Failed to release pre-orders: %v", err)
+		} else if count > 0 {
+			log.Printf("Released %d pre-ordered items", count)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Characters used in order numbers, leaving out ones that are easy to misread (0/O, 1/I)
+const orderNumberAlphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+
+// Generate a random, non-sequential order number such as "BK-7KQ2M9XHTD" that isn't used by
+// another order yet. The prefix comes from ORDER_NUMBER_PREFIX.
+func newOrderNumber(tx *gorm.DB) (string, error) {
+	prefix := os.Getenv("ORDER_NUMBER_PREFIX")
+	if prefix == "" {
+		prefix = "BK"
+	}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		random := make([]byte, 10)
+		if _, err := crand.Read(random); err != nil {
+			return "", err
+		}
+		for i, b := range random {
+			random[i] = orderNumberAlphabet[int(b)%len(orderNumberAlphabet)]
+		}
+		number := prefix + "-" + string(random)
+
+		var taken int64
+		if err := tx.Model(&database.Order{}).Unscoped().Where("order_number = ?", number).Count(&taken).Error; err != nil {
+			return "", err
+		}
+		if taken == 0 {
+			return number, nil
+		}
+	}
+
+	return "", errors.New("could not generate a unique order number")
+}
+
+// Turn the user's cart into an order, taking the books out of stock
+func PlaceOrderHandler(c *fiber.Ctx) error {
+	// Parse the user ID from the JWT token
+	token := c.Locals("user").(*jwt.Token)
+	claims := token.Claims.(jwt.MapClaims)
+	userID := uint(claims["user_id"].(float64))
+
+	order := database.Order{
+		UserID: userID,
+		Status: database.OrderStatusCompleted,
+	}
+	err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+		var err error
+		order.Items, order.Total, err = checkoutCart(tx, userID)
+		if err != nil {
+			return err
+		}
+		for _, item := range order.Items {
+			if item.Status == database.OrderStatusPreOrdered {
+				order.Status = database.OrderStatusPreOrdered
+			}
+		}
+		if order.OrderNumber, err = newOrderNumber(tx); err != nil {
+			return err
+		}
+		return tx.Create(&order).Error
+	})
+
+	var stockErr *insufficientStockError
+	var limitErr *purchaseLimitError
+	switch {
+	case errors.Is(err, errCartEmpty):
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Cart is empty")
+	case errors.As(err, &stockErr):
+		return middleware.RespondErrorData(c, fiber.StatusBadRequest, fmt.Sprintf("Only %d copies of %q available", max(stockErr.Book.Quantity, 0), stockErr.Book.Title), fiber.Map{
+			"book_id": stockErr.Book.ID,
+		})
+	case errors.As(err, &limitErr):
+		var remaining uint
+		if limitErr.Purchased < *limitErr.Book.MaxPerUser {
+			remaining = *limitErr.Book.MaxPerUser - limitErr.Purchased
+		}
+		return middleware.RespondErrorData(c, fiber.StatusBadRequest, fmt.Sprintf("You can buy at most %d copies of %q", *limitErr.Book.MaxPerUser, limitErr.Book.Title), fiber.Map{
+			"book_id":   limitErr.Book.ID,
+			"remaining": remaining,
+		})
+	case err != nil:
+		return middleware.Internal(err, "Failed to place order")
+	}
+
+	return middleware.RespondOK(c, order)
+}
+
+// Get the user's order history with line items, newest first
+func GetUserOrdersHandler(c *fiber.Ctx) error {
+	// Parse the user ID from the JWT token
+	token := c.Locals("user").(*jwt.Token)
+	claims := token.Claims.(jwt.MapClaims)
+	userID := uint(claims["user_id"].(float64))
+
+	page, limit := parsePagination(c, defaultPageSize)
+	query := requestDB(c).Model(&database.Order{}).Where("user_id = ?", userID).Session(&gorm.Session{})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch orders")
+	}
+
+	var orders []database.Order
+	if err := query.Preload("Items").
+		Order("created_at DESC, id DESC").
+		Offset((page - 1) * limit).
+		Limit(limit).
+		Find(&orders).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch orders")
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
+		"orders": orders,
+		"total":  total,
+		"page":   page,
+		"limit":  limit,
+	})
+}
+
+// The fields a user can set on a review
+type reviewRequest struct {
+	Rating  int    `json:"rating" validate:"required,min=1,max=5"`
+	Comment string `json:"comment" validate:"max=2000"`
+}
+
+// Add a review for a book
+func AddReviewHandler(c *fiber.Ctx) error {
+	// Parse the book ID from the URL parameter
+	bookIDStr := c.Params("book_id")
+
+	// Convert the book ID to a uint
+	bookID, err := strconv.ParseUint(bookIDStr, 10, 32)
+	if err != nil {
+		// Handle invalid ID format
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid ID format")
+	}
+
+	// Convert the book ID to a uint
+	bookIDUint := uint(bookID)
+
+	// Parse the user ID from the JWT token
+	token := c.Locals("user").(*jwt.Token)
+	claims := token.Claims.(jwt.MapClaims)
+	userID := uint(claims["user_id"].(float64))
+
+	// Check if the book exists, including soft-deleted books so they can be reported clearly
+	var book database.Book
+	if err := requestDB(c).Unscoped().First(&book, bookIDUint).Error; err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "Book not found")
+	}
+
+	// Deleted books keep their existing reviews but can't receive new ones
+	if book.DeletedAt.Valid {
+		return middleware.RespondError(c, fiber.StatusConflict, "This book has been removed and can no longer be reviewed")
+	}
+
+	// Check if the user exists
+	var user database.User
+	if err := requestDB(c).First(&user, userID).Error; err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "User not found")
+	}
+
+	// Parse the review data from the request body
+	var request reviewRequest
+	if err := c.BodyParser(&request); err != nil {
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid input data")
+	}
+
+	// Validate the input
+	if err := validate.Struct(request); err != nil {
+		return middleware.RespondValidationError(c, "Invalid input data", err)
+	}
+
+	review := database.Review{
+		BookID:  bookIDUint,
+		UserID:  userID,
+		Rating:  request.Rating,
+		Comment: sanitizeComment(request.Comment),
+	}
+
+	// Check for an earlier review and save the new one in a single transaction. Two concurrent
+	// requests can both pass the check, in which case the unique index rejects the second insert.
+	cooldown := optionalDurationFromEnv("REVIEW_COOLDOWN", time.Minute)
+	var wait time.Duration
+	err = requestDB(c).Transaction(func(tx *gorm.DB) error {
+		// Check if the user has already reviewed the book
+		var existingReview database.Review
+		if err := tx.Where("user_id = ? AND book_id = ?", userID, bookIDUint).First(&existingReview).Error; err == nil {
+			return gorm.ErrDuplicatedKey
+		}
+
+		// Only allow one new review per cooldown period, across all books. Deleted reviews still
+		// count, so deleting a review doesn't reset the cooldown.
+		var lastReview database.Review
+		if err := tx.Unscoped().Where("user_id = ?", userID).Order("created_at DESC").First(&lastReview).Error; err == nil {
+			if wait = cooldown - time.Since(lastReview.CreatedAt); wait > 0 {
+				return nil
+			}
+		}
+
+		// Save the review to the database
+		return tx.Create(&review).Error
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return middleware.RespondError(c, fiber.StatusConflict, "You have already reviewed this book")
+	}
+	if err != nil {
+		return middleware.Internal(err, "Failed to add review")
+	}
+	if wait > 0 {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return middleware.RespondError(c, fiber.StatusTooManyRequests, "You are posting reviews too quickly, please try again later")
+	}
+
+	// Fetch the review again from the database to get the created_at value
+	if err := requestDB(c).Where("id = ?", review.ID).First(&review).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch review")
+	}
+
+	return middleware.RespondOK(c, review)
+}
+
+var htmlTagPattern = regexp.MustCompile(`<[^<>]*>`)
+
+// Make a review comment safe to render by removing HTML tags. Comments are stored as plain
+// text for clients to escape when rendering, so "Don't" stays as written. With
+// REVIEW_COMMENT_FORMAT=markdown any stray "<" is removed too, so a markdown renderer can't
+// turn it into HTML, while markdown such as "> quote" or "**bold**" is kept.
+func sanitizeComment(comment string) string {
+	// Strip until nothing changes, so removing one tag can't leave another behind as in "<scr<b>ipt>"
+	stripped := comment
+	for {
+		next := htmlTagPattern.ReplaceAllString(stripped, "")
+		if next == stripped {
+			break
+		}
+		stripped = next
+	}
+	if strings.EqualFold(os.Getenv("REVIEW_COMMENT_FORMAT"), "markdown") {
+		return strings.ReplaceAll(stripped, "<", "")
+	}
+	return stripped
+}
+
+// Find a review for the user to change, writing a 404 or 403 response if they can't. Ownership
+// is checked for every caller, admins included.
+func findOwnReview(c *fiber.Ctx) (database.Review, bool, error) {
+	// Parse the user ID from the JWT token
+	token := c.Locals("user").(*jwt.Token)
+	claims := token.Claims.(jwt.MapClaims)
+	userID := uint(claims["user_id"].(float64))
+
+	var review database.Review
+	if err := requestDB(c).First(&review, c.Params("id")).Error; err != nil {
+		return review, false, middleware.RespondError(c, fiber.StatusNotFound, "Review not found")
+	}
+
+	if review.UserID != userID {
+		return review, false, middleware.RespondError(c, fiber.StatusForbidden, "You can only change your own reviews")
+	}
+
+	return review, true, nil
+}
+
+// Update the rating and comment of the user's own review
+func UpdateReviewHandler(c *fiber.Ctx) error {
+	review, ok, err := findOwnReview(c)
+	if !ok {
+		return err
+	}
+
+	var request reviewRequest
+	if err := c.BodyParser(&request); err != nil {
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid input data")
+	}
+
+	// Validate the input
+	if err := validate.Struct(request); err != nil {
+		return middleware.RespondValidationError(c, "Invalid input data", err)
+	}
+
+	review.Rating = request.Rating
+	review.Comment = sanitizeComment(request.Comment)
+	if err := requestDB(c).Save(&review).Error; err != nil {
+		return middleware.Internal(err, "Failed to update review")
+	}
+
+	return middleware.RespondOK(c, review)
+}
+
+// Delete the user's own review, letting them post a new one
+func DeleteReviewHandler(c *fiber.Ctx) error {
+	review, ok, err := findOwnReview(c)
+	if !ok {
+		return err
+	}
+
+	if err := requestDB(c).Delete(&review).Error; err != nil {
+		return middleware.Internal(err, "Failed to delete review")
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
+		"message": "Review deleted",
+	})
+}
+
+// Get reviews for a book with user names
+func GetBookReviewsHandler(c *fiber.Ctx) error {
+	// Parse the book ID from the URL parameter
+	bookID := c.Params("book_id")
+
+	// Find all reviews for the book and include user information. Querying the model keeps
+	// deleted reviews out.
+	var reviews []struct {
+		database.Review
+		FirstName string `json:"first_name"`
+		CreatedAt string `json:"created_at"`
+	}
+	if err := requestDB(c).Model(&database.Review{}).
+		Select("reviews.*, users.first_name, reviews.created_at").
+		Joins("LEFT JOIN users ON users.id = reviews.user_id").
+		Where("reviews.book_id = ?", bookID).
+		Scan(&reviews).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch reviews")
+	}
+
+	if len(reviews) == 0 {
+		return middleware.RespondOK(c, fiber.Map{
+			"message": "No reviews for this book",
+		})
+	}
+
+	// Return the reviews with user first names and CreatedAt
+	return middleware.RespondOK(c, reviews)
+}
+
+// Send the book's file to a user who has bought it. Admins can download any book.
+func DownloadBookHandler(c *fiber.Ctx) error {
+	// Parse the user ID from the JWT token
+	token := c.Locals("user").(*jwt.Token)
+	claims := token.Claims.(jwt.MapClaims)
+	userID := uint(claims["user_id"].(float64))
+
+	// Parse the book ID from the URL parameter
+	bookID := c.Params("id")
+
+	// Find the book in the database by ID
+	var book database.Book
+	if err := requestDB(c).First(&book, bookID).Error; err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "Book not found")
+	}
+
+	var user database.User
+	if err := requestDB(c).First(&user, userID).Error; err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "User not found")
+	}
+
+	// Only buyers can download the book, and pre-orders only once the book is released
+	if user.Role != database.UserRoleAdmin {
+		purchased, err := hasCompletedPurchase(requestDB(c), userID, book.ID)
+		if err != nil {
+			return middleware.Internal(err, "Failed to check purchase")
+		}
+		if !purchased {
+			return middleware.RespondError(c, fiber.StatusForbidden, "You need to buy this book before downloading it")
+		}
+	}
+
+	if info, err := os.Stat(book.Path); book.Path == "" || err != nil || info.IsDir() {
+		return middleware.RespondError(c, fiber.StatusNotFound, "The file for this book is not available")
+	}
+
+	// Name the download after the book, keeping the file's extension for the content type
+	return c.Download(book.Path, downloadFilename(book))
+}
+
+// Location of uploaded covers and book files, from UPLOAD_DIR
+func uploadDir() string {
+	if dir := os.Getenv("UPLOAD_DIR"); dir != "" {
+		return dir
+	}
+	return "uploads"
+}
+
+// Public URL prefix that uploaded covers are served under
+const coverURLPrefix = "/covers/"
+
+// Cover image types that can be uploaded, with the extension they are stored under
+var coverExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// Work out the stored extension of a cover from its first bytes
+func detectCover(head []byte) (string, bool) {
+	ext, ok := coverExtensions[http.DetectContentType(head)]
+	return ext, ok
+}
+
+// Work out the stored extension of a book file from its first bytes. An EPUB is a zip archive
+// whose first entry is an uncompressed "mimetype" file naming the EPUB type.
+func detectBookFile(head []byte) (string, bool) {
+	if http.DetectContentType(head) == "application/pdf" {
+		return ".pdf", true
+	}
+	if len(head) >= 58 && string(head[:4]) == "PK\x03\x04" && string(head[30:58]) == "mimetypeapplication/epub+zip" {
+		return ".epub", true
+	}
+	return "", false
+}
+
+// The size limit of each uploaded file in MB
+func uploadMaxMB() int {
+	return intFromEnv("UPLOAD_MAX_MB", 20)
+}
+
+// UploadBodyLimit is the request body size that fits a cover and a book file at the
+// UPLOAD_MAX_MB limit, with 5MB to spare for the rest of the form
+func UploadBodyLimit() int {
+	return (2*uploadMaxMB() + 5) << 20
+}
+
+// Check an uploaded file's size and type by its contents, writing a 413 or 400 response if it
+// is rejected. kind names the form field in error messages.
+func checkUpload(c *fiber.Ctx, file *multipart.FileHeader, kind, allowed string, detect func([]byte) (string, bool)) (string, bool, error) {
+	limitMB := uploadMaxMB()
+	if file.Size > int64(limitMB)<<20 {
+		return "", false, middleware.RespondError(c, fiber.StatusRequestEntityTooLarge, fmt.Sprintf("The %s must be at most %dMB", kind, limitMB))
+	}
+
+	f, err := file.Open()
+	if err != nil {
+		return "", false, middleware.Internal(err, "Failed to read upload")
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", false, middleware.Internal(err, "Failed to read upload")
+	}
+
+	ext, ok := detect(head[:n])
+	if !ok {
+		return "", false, middleware.RespondError(c, fiber.StatusBadRequest, fmt.Sprintf("The %s must be %s", kind, allowed))
+	}
+	return ext, true, nil
+}
+
+// Store an upload in a subdirectory of the upload directory under a generated name, returning
+// the path it was saved to
+func storeUpload(c *fiber.Ctx, file *multipart.FileHeader, subdir, ext string) (string, error) {
+	dir := filepath.Join(uploadDir(), subdir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	random := make([]byte, 16)
+	if _, err := crand.Read(random); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, hex.EncodeToString(random)+ext)
+	return path, c.SaveFile(file, path)
+}
+
+// Upload a book's cover image and/or book file as the multipart fields "cover" and "file".
+// The files are stored under generated names in the upload directory and replace any the
+// book already had.
+func UploadBookFilesHandler(c *fiber.Ctx) error {
+	var book database.Book
+	if err := requestDB(c).First(&book, c.Params("id")).Error; err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "Book not found")
+	}
+
+	cover, _ := c.FormFile("cover")
+	file, _ := c.FormFile("file")
+	if cover == nil && file == nil {
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Upload a cover, a file, or both")
+	}
+
+	// Check everything before storing anything
+	var coverExt, fileExt string
+	if cover != nil {
+		ext, ok, err := checkUpload(c, cover, "cover", "a JPEG, PNG, GIF, or WebP image", detectCover)
+		if !ok {
+			return err
+		}
+		coverExt = ext
+	}
+	if file != nil {
+		ext, ok, err := checkUpload(c, file, "file", "a PDF or EPUB", detectBookFile)
+		if !ok {
+			return err
+		}
+		fileExt = ext
+	}
+
+	// Remove what this request stored if a later step fails
+	var stored []string
+	cleanup := func() {
+		for _, path := range stored {
+			if err := os.Remove(path); err != nil {
+				log.Printf("Failed to remove upload %s: %v", path, err)
+			}
+		}
+	}
+
+	oldImage, oldPath := book.Image, book.Path
+	if cover != nil {
+		path, err := storeUpload(c, cover, "covers", coverExt)
+		if err != nil {
+			cleanup()
+			return middleware.Internal(err, "Failed to store cover")
+		}
+		stored = append(stored, path)
+		book.Image = coverURLPrefix + filepath.Base(path)
+	}
+	if file != nil {
+		path, err := storeUpload(c, file, "files", fileExt)
+		if err != nil {
+			cleanup()
+			return middleware.Internal(err, "Failed to store book file")
+		}
+		stored = append(stored, path)
+		book.Path = path
+	}
+
+	if err := requestDB(c).Model(&book).UpdateColumns(map[string]interface{}{
+		"image": book.Image,
+		"path":  book.Path,
+	}).Error; err != nil {
+		cleanup()
+		return middleware.Internal(err, "Failed to update book")
+	}
+
+	// Remove replaced uploads, leaving alone covers and files that live elsewhere
+	if cover != nil && strings.HasPrefix(oldImage, coverURLPrefix) {
+		os.Remove(filepath.Join(uploadDir(), "covers", filepath.Base(oldImage)))
+	}
+	if file != nil && oldPath != "" && filepath.Dir(oldPath) == filepath.Join(uploadDir(), "files") {
+		os.Remove(oldPath)
+	}
+
+	response := fiber.Map{"book": book}
+	if book.Image != "" {
+		response["cover_url"] = book.Image
+	}
+	if book.Path != "" {
+		response["file_url"] = fmt.Sprintf("/user/book/%d/download", book.ID)
+	}
+	return middleware.RespondOK(c, response)
+}
+
+// Build a safe attachment filename from the book title and the extension of its file
+func downloadFilename(book database.Book) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' {
+			return r
+		}
+		if unicode.IsSpace(r) {
+			return '_'
+		}
+		return -1
+	}, book.Title)
+	if name == "" {
+		name = "book-" + strconv.Itoa(int(book.ID))
+	}
+	return name + filepath.Ext(book.Path)
+}
+
+// Cart section for admin to see all the users cart items
+func GetAllCartItemsHandler(c *fiber.Ctx) error {
+	var cartItems []database.CartItem
+	if err := requestDB(c).Find(&cartItems).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch cart items")
+	}
+
+	if len(cartItems) == 0 {
+		return middleware.RespondOK(c, fiber.Map{
+			"message": "Cart is empty",
+		})
+	}
+
+	// Return the cart items
+	return middleware.RespondOK(c, cartItems)
+}
+
+// Find an order by its order number, or by ID when the reference is numeric
+func findOrder(db *gorm.DB, ref string) (database.Order, error) {
+	var order database.Order
+	query := db.Preload("Items")
+	if id, err := strconv.ParseUint(ref, 10, 32); err == nil {
+		query = query.Where("id = ?", id)
+	} else {
+		query = query.Where("order_number = ?", ref)
+	}
+	err := query.First(&order).Error
+	return order, err
+}
+
+// Get one of the user's orders by order number or ID
+func GetUserOrderHandler(c *fiber.Ctx) error {
+	// Parse the user ID from the JWT token
+	token := c.Locals("user").(*jwt.Token)
+	claims := token.Claims.(jwt.MapClaims)
+	userID := uint(claims["user_id"].(float64))
+
+	order, err := findOrder(requestDB(c).Where("user_id = ?", userID), c.Params("ref"))
+	if err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "Order not found")
+	}
+
+	return middleware.RespondOK(c, order)
+}
+
+// Get any order by order number or ID
+func GetOrderHandler(c *fiber.Ctx) error {
+	order, err := findOrder(requestDB(c), c.Params("ref"))
+	if err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "Order not found")
+	}
+
+	return middleware.RespondOK(c, order)
+}
+
+// Get all orders across users, newest first, optionally filtered by user and status
+func GetAllOrdersHandler(c *fiber.Ctx) error {
+	page, limit := parsePagination(c, defaultPageSize)
+
+	query := requestDB(c).Model(&database.Order{})
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	query = query.Session(&gorm.Session{})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch orders")
+	}
+
+	var orders []database.Order
+	if err := query.Preload("Items").
+		Order("created_at DESC, id DESC").
+		Offset((page - 1) * limit).
+		Limit(limit).
+		Find(&orders).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch orders")
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
+		"orders": orders,
+		"total":  total,
+		"page":   page,
+		"limit":  limit,
+	})
+}
+
+// Get a user's cart items
+func GetUserCartHandler(c *fiber.Ctx) error {
+	// Parse the user ID from the URL parameter
+	userID := c.Params("user_id")
+
+	// Find all cart items for the user
+	var cartItems []database.CartItem
+	if err := requestDB(c).Where("user_id = ?", userID).Find(&cartItems).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch cart items")
+	}
+
+	if len(cartItems) == 0 {
+		return middleware.RespondOK(c, fiber.Map{
+			"message": "Cart is empty",
+		})
+	}
+
+	// Return the cart items
+	return middleware.RespondOK(c, cartItems)
+}
+
+// Remove an item from the user's cart
+func DeleteCartItemHandler(c *fiber.Ctx) error {
+	// Parse the user ID from the URL parameter
+	userID := c.Params("user_id")
+
+	// Parse the book ID from the URL parameter
+	bookID := c.Params("book_id")
+
+	// Find the cart item to remove
+	var cartItem database.CartItem
+	if err := requestDB(c).Where("user_id = ? AND book_id = ?", userID, bookID).First(&cartItem).Error; err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "Cart item not found")
+	}
+
+	// Delete the cart item
+	if err := requestDB(c).Delete(&cartItem).Error; err != nil {
+		return middleware.Internal(err, "Failed to remove item from cart")
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
+		"message": "Item removed from cart",
+	})
+}
+
+// Get the role of the user from the database
+func GetUserRoleHandler(c *fiber.Ctx) error {
+	// Parse the user ID from the URL parameter
+	userID := c.Params("id")
+
+	// Find the user in the database
+	var user database.User
+	if err := requestDB(c).First(&user, userID).Error; err != nil {
+		// Handle database errors (e.g., no user with the given ID)
+		return middleware.RespondError(c, fiber.StatusNotFound, "User not found")
+	}
+	return middleware.RespondOK(c, fiber.Map{
+		"role": user.Role,
+	})
+}
+
+// Delete user handler
+func DeleteUserHandler(c *fiber.Ctx) error {
+	// Parse the user ID from the URL parameter
+	userID := c.Params("id")
+
+	// Find the user in the database
+	var user database.User
+	if err := requestDB(c).First(&user, userID).Error; err != nil {
+		// Handle database errors (e.g., no user with the given ID)
+		return middleware.RespondError(c, fiber.StatusNotFound, "User not found")
+	}
+
+	// Delete the user from the database and end their sessions
+	if err := requestDB(c).Delete(&user).Error; err != nil {
+		return middleware.Internal(err, "Failed to delete user")
+	}
+	if err := revokeSessions(requestDB(c), user.ID); err != nil {
+		return middleware.Internal(err, "Failed to delete user")
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
+		"message": "User deleted successfully",
+	})
+}
+
+// Default and maximum number of items returned per page
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// Parse the "page" and "limit" query parameters, falling back to sane defaults
+func parsePagination(c *fiber.Ctx, defaultLimit int) (int, int) {
+	page := c.QueryInt("page", 1)
+	if page < 1 {
+		page = 1
+	}
+
+	limit := c.QueryInt("limit", defaultLimit)
+	if limit < 1 {
+		limit = defaultLimit
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	return page, limit
+}
+
+// Get reviews across all books, optionally filtered by comment text and creation date
+func GetReviewsHandler(c *fiber.Ctx) error {
+	page, limit := parsePagination(c, defaultPageSize)
+
+	query := requestDB(c).Model(&database.Review{})
+
+	// Only include reviews whose comment contains the search text, ignoring case
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		query = query.Where("LOWER(reviews.comment) LIKE ?", "%"+strings.ToLower(q)+"%")
+	}
+
+	// Only include reviews created on or after the "from" date
+	if from := c.Query("from"); from != "" {
+		fromDate, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid from date, expected YYYY-MM-DD")
+		}
+		query = query.Where("reviews.created_at >= ?", fromDate)
+	}
+
+	// Only include reviews created on or before the end of the "to" date
+	if to := c.Query("to"); to != "" {
+		toDate, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid to date, expected YYYY-MM-DD")
+		}
+		query = query.Where("reviews.created_at < ?", toDate.AddDate(0, 0, 1))
+	}
+
+	// Allow the filtered query to be reused for both the count and the page
+	query = query.Session(&gorm.Session{})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch reviews")
+	}
+
+	// Include the book title and reviewer details with each review
+	var reviews []struct {
+		database.Review
+		BookTitle string `json:"book_title"`
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+		Email     string `json:"email"`
+	}
+	if err := query.
+		Select("reviews.*, books.title AS book_title, users.first_name, users.last_name, users.email").
+		Joins("LEFT JOIN books ON books.id = reviews.book_id").
+		Joins("LEFT JOIN users ON users.id = reviews.user_id").
+		Order("reviews.created_at DESC").
+		Offset((page - 1) * limit).
+		Limit(limit).
+		Scan(&reviews).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch reviews")
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
+		"reviews": reviews,
+		"total":   total,
+		"page":    page,
+		"limit":   limit,
+	})
+}
+
+// Recalculate and store the average rating of a book from its reviews
+func updateAverageRating(db *gorm.DB, bookID uint) error {
+	var average float64
+	if err := db.Model(&database.Review{}).
+		Select("COALESCE(AVG(rating), 0)").
+		Where("book_id = ?", bookID).
+		Scan(&average).Error; err != nil {
+		return err
+	}
+
+	return db.Model(&database.Book{}).Where("id = ?", bookID).Update("average_rating", average).Error
+}
+
+// Seed randomized reviews for QA, skipping user/book pairs that already have a review
+func SeedReviewsHandler(c *fiber.Ctx) error {
+	var request struct {
+		Count int `json:"count" validate:"omitempty,min=1,max=10000"`
+	}
+
+	if err := c.BodyParser(&request); err != nil && len(c.Body()) > 0 {
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid input data")
+	}
+
+	// Validate the input
+	if err := validate.Struct(request); err != nil {
+		return middleware.RespondValidationError(c, "Invalid input data", err)
+	}
+
+	if request.Count == 0 {
+		request.Count = 50
+	}
+
+	var userIDs, bookIDs []uint
+	if err := requestDB(c).Model(&database.User{}).Pluck("id", &userIDs).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch users")
+	}
+	if err := requestDB(c).Model(&database.Book{}).Pluck("id", &bookIDs).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch books")
+	}
+
+	// Collect the pairs that already have a review so they are skipped
+	var existing []database.Review
+	if err := requestDB(c).Select("user_id", "book_id").Find(&existing).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch reviews")
+	}
+
+	reviewed := make(map[[2]uint]bool, len(existing))
+	for _, review := range existing {
+		reviewed[[2]uint{review.UserID, review.BookID}] = true
+	}
+
+	var candidates [][2]uint
+	for _, userID := range userIDs {
+		for _, bookID := range bookIDs {
+			if !reviewed[[2]uint{userID, bookID}] {
+				candidates = append(candidates, [2]uint{userID, bookID})
+			}
+		}
+	}
+
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > request.Count {
+		candidates = candidates[:request.Count]
+	}
+
+	comments := []string{
+		"Loved every page of it.",
+		"A solid read, would recommend.",
+		"Not quite what I expected.",
+		"Slow start but worth finishing.",
+		"One of the best books I have read this year.",
+	}
+
+	affectedBooks := map[uint]bool{}
+	err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+		for _, pair := range candidates {
+			review := database.Review{
+				UserID:  pair[0],
+				BookID:  pair[1],
+				Rating:  rand.Intn(5) + 1,
+				Comment: comments[rand.Intn(len(comments))],
+			}
+			if err := tx.Create(&review).Error; err != nil {
+				return err
+			}
+			affectedBooks[pair[1]] = true
+		}
+
+		// Recompute the ratings of every book that received new reviews
+		for bookID := range affectedBooks {
+			if err := updateAverageRating(tx, bookID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return middleware.Internal(err, "Failed to seed reviews")
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
+		"created":        len(candidates),
+		"books_affected": len(affectedBooks),
+	})
+}
+
+// Get books whose stock is at or below their reorder threshold
+func GetReorderListHandler(c *fiber.Ctx) error {
+	var books []database.Book
+	if err := requestDB(c).
+		Where("quantity <= COALESCE(reorder_threshold, ?)", database.DefaultReorderThreshold()).
+		Order("quantity ASC").
+		Find(&books).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch books")
+	}
+	if err := attachReviewStats(requestDB(c), books); err != nil {
+		return middleware.Internal(err, "Failed to fetch ratings")
+	}
+
+	// Suggest restocking each book to twice its threshold
+	type reorderItem struct {
+		database.Book
+		SuggestedQuantity int `json:"suggested_quantity"`
+	}
+	items := make([]reorderItem, 0, len(books))
+	for _, book := range books {
+		suggested := 2*book.EffectiveReorderThreshold() - book.Quantity
+		if suggested < 1 {
+			suggested = 1
+		}
+		items = append(items, reorderItem{Book: book, SuggestedQuantity: suggested})
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
+		"books": items,
+	})
+}
+
+// Merge a duplicate book into another, moving its cart items, reviews, and stock
+func MergeBooksHandler(c *fiber.Ctx) error {
+	var request struct {
+		SourceID uint `json:"source_id" validate:"required"`
+		TargetID uint `json:"target_id" validate:"required,nefield=SourceID"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid input data")
+	}
+
+	// Validate the input
+	if err := validate.Struct(request); err != nil {
+		return middleware.RespondValidationError(c, "Invalid input data", err)
+	}
+
+	var source, target database.Book
+	if err := requestDB(c).First(&source, request.SourceID).Error; err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "Source book not found")
+	}
+	if err := requestDB(c).Preload("PriceTiers").First(&target, request.TargetID).Error; err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "Target book not found")
+	}
+
+	err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+		// Move cart items, combining them when the user already has the target in their cart
+		var cartItems []database.CartItem
+		if err := tx.Where("book_id = ?", source.ID).Find(&cartItems).Error; err != nil {
+			return err
+		}
+		for _, item := range cartItems {
+			var existing database.CartItem
+			err := tx.Where("user_id = ? AND book_id = ?", item.UserID, target.ID).First(&existing).Error
+			if err == nil {
+				existing.Quantity += item.Quantity
+				existing.Subtotal = calculateSubtotal(target, existing.Quantity)
+				if err := tx.Save(&existing).Error; err != nil {
+					return err
+				}
+				if err := tx.Delete(&item).Error; err != nil {
+					return err
+				}
+				continue
+			}
+			if err != gorm.ErrRecordNotFound {
+				return err
+			}
+
+			item.BookID = target.ID
+			item.Subtotal = calculateSubtotal(target, item.Quantity)
+			if err := tx.Save(&item).Error; err != nil {
+				return err
+			}
+		}
+
+		// Move reviews, keeping only the newer one when a user reviewed both books
+		var reviews []database.Review
+		if err := tx.Where("book_id = ?", source.ID).Find(&reviews).Error; err != nil {
+			return err
+		}
+		for _, review := range reviews {
+			var existing database.Review
+			err := tx.Where("user_id = ? AND book_id = ?", review.UserID, target.ID).First(&existing).Error
+			if err == nil {
+				if !review.CreatedAt.After(existing.CreatedAt) {
+					if err := tx.Delete(&review).Error; err != nil {
+						return err
+					}
+					continue
+				}
+				if err := tx.Delete(&existing).Error; err != nil {
+					return err
+				}
+			} else if err != gorm.ErrRecordNotFound {
+				return err
+			}
+
+			if err := tx.Model(&review).Update("book_id", target.ID).Error; err != nil {
+				return err
+			}
+		}
+
+		// Combine the stock and retire the duplicate
+		if err := tx.Model(&target).Update("quantity", target.Quantity+source.Quantity).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&source).Error; err != nil {
+			return err
+		}
+
+		return updateAverageRating(tx, target.ID)
+	})
+	if err != nil {
+		return middleware.Internal(err, "Failed to merge books")
+	}
+
+	// Return the merged book
+	if err := requestDB(c).Preload("PriceTiers").First(&target, target.ID).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch book")
+	}
+
+	return middleware.RespondOK(c, target)
+}
+
+// Feature or unfeature every book matching a genre, author, or list of IDs
+func BulkSetFeaturedHandler(c *fiber.Ctx) error {
+	var request struct {
+		Genre    string `json:"genre"`
+		Author   string `json:"author"`
+		IDs      []uint `json:"ids"`
+		Featured *bool  `json:"featured" validate:"required"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid input data")
+	}
+
+	// Validate the input
+	if err := validate.Struct(request); err != nil {
+		return middleware.RespondValidationError(c, "Invalid input data", err)
+	}
+
+	// Refuse to touch the whole catalog without a filter
+	if request.Genre == "" && request.Author == "" && len(request.IDs) == 0 {
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Provide a genre, author, or ids to filter by")
+	}
+
+	query := requestDB(c).Model(&database.Book{})
+	if request.Genre != "" {
+		query = query.Where("LOWER(genre) = LOWER(?)", request.Genre)
+	}
+	if request.Author != "" {
+		query = query.Where("LOWER(author) = LOWER(?)", request.Author)
+	}
+	if len(request.IDs) > 0 {
+		query = query.Where("id IN ?", request.IDs)
+	}
+
+	result := query.Update("featured", *request.Featured)
+	if result.Error != nil {
+		return middleware.Internal(result.Error, "Failed to update books")
+	}
+
+	// Keep a record of who changed the featured shelf
+	adminID := uint(c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)["user_id"].(float64))
+	log.Printf("Admin %d set featured=%v on %d books (genre=%q author=%q ids=%v)",
+		adminID, *request.Featured, result.RowsAffected, request.Genre, request.Author, request.IDs)
+
+	return middleware.RespondOK(c, fiber.Map{
+		"updated": result.RowsAffected,
+	})
+}
+
+// Remove every out-of-stock book from the featured shelf
+func BulkUnfeatureOutOfStockHandler(c *fiber.Ctx) error {
+	result := requestDB(c).Model(&database.Book{}).
+		Where("featured = ? AND quantity <= 0", true).
+		Update("featured", false)
+	if result.Error != nil {
+		return middleware.Internal(result.Error, "Failed to update books")
+	}
+
+	adminID := uint(c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)["user_id"].(float64))
+	log.Printf("Admin %d unfeatured %d out-of-stock books", adminID, result.RowsAffected)
+
+	return middleware.RespondOK(c, fiber.Map{
+		"updated": result.RowsAffected,
+	})
+}
+
+// Take a book off the featured shelf when it runs out of stock and AUTO_UNFEATURE_OUT_OF_STOCK
+// is enabled. Restocking never features it again.
+func unfeatureIfOutOfStock(book *database.Book) {
+	if book.Featured && book.Quantity <= 0 && os.Getenv("AUTO_UNFEATURE_OUT_OF_STOCK") == "true" {
+		book.Featured = false
+	}
+}
+
+// Normalize the genre of every existing book, returning how many were changed
+func NormalizeGenresHandler(c *fiber.Ctx) error {
+	var genres []string
+	if err := requestDB(c).Model(&database.Book{}).Distinct().Pluck("genre", &genres).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch genres")
+	}
+
+	var updated int64
+	err := requestDB(c).Transaction(func(tx *gorm.DB) error {
+		for _, genre := range genres {
+			normalized := normalizeGenre(genre)
+			if normalized == genre {
+				continue
+			}
+			result := tx.Model(&database.Book{}).Where("genre = ?", genre).Update("genre", normalized)
+			if result.Error != nil {
+				return result.Error
+			}
+			updated += result.RowsAffected
+		}
+		return nil
+	})
+	if err != nil {
+		return middleware.Internal(err, "Failed to normalize genres")
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
+		"updated": updated,
+	})
+}
+
+// Get shelves of the best rated (or newest) books for the genres with the most titles
+func GetStorefrontHandler(c *fiber.Ctx) error {
+	genreCount := c.QueryInt("genres", intFromEnv("STOREFRONT_GENRES", 4))
+	perGenre := c.QueryInt("per_genre", intFromEnv("STOREFRONT_BOOKS_PER_GENRE", 6))
+	if genreCount < 1 || genreCount > 20 || perGenre < 1 || perGenre > 50 {
+		return middleware.RespondError(c, fiber.StatusBadRequest, "genres must be 1-20 and per_genre must be 1-50")
+	}
+
+	shelfOrder := bookSortColumns["average_rating"] + " DESC, books.id DESC"
+	switch c.Query("sort", "rating") {
+	case "rating":
+	case "recent":
+		shelfOrder = "books.id DESC"
+	default:
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid sort, expected rating or recent")
+	}
+
+	// Pick the genres with the most titles
+	var genres []string
+	if err := requestDB(c).Model(&database.Book{}).
+		Where("genre <> ''").
+		Group("genre").
+		Order("COUNT(*) DESC, genre").
+		Limit(genreCount).
+		Pluck("genre", &genres).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch genres")
+	}
+
+	// Rank books within each genre and keep the top few, all in one query
+	var books []database.Book
+	if len(genres) > 0 {
+		ranked := requestDB(c).Model(&database.Book{}).
+			Select("books.*, ROW_NUMBER() OVER (PARTITION BY genre ORDER BY "+shelfOrder+") AS shelf_rank").
+			Joins("LEFT JOIN (?) AS review_stats ON review_stats.book_id = books.id", reviewStatsQuery(requestDB(c))).
+			Where("genre IN ?", genres)
+		if err := requestDB(c).Table("(?) AS ranked", ranked).
+			Where("shelf_rank <= ?", perGenre).
+			Order("shelf_rank").
+			Find(&books).Error; err != nil {
+			return middleware.Internal(err, "Failed to fetch books")
+		}
+	}
+	if err := attachReviewStats(requestDB(c), books); err != nil {
+		return middleware.Internal(err, "Failed to fetch ratings")
+	}
+
+	type shelfBook struct {
+		database.Book
+		OutOfStock bool `json:"out_of_stock"`
+	}
+	type shelf struct {
+		Genre string      `json:"genre"`
+		Books []shelfBook `json:"books"`
+	}
+
+	shelves := make([]shelf, len(genres))
+	index := make(map[string]int, len(genres))
+	for i, genre := range genres {
+		shelves[i] = shelf{Genre: genre, Books: []shelfBook{}}
+		index[genre] = i
+	}
+	for _, book := range books {
+		i := index[book.Genre]
+		shelves[i].Books = append(shelves[i].Books, shelfBook{Book: book, OutOfStock: book.Quantity <= 0})
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
+		"shelves": shelves,
+	})
+}
+
+// Get users who registered within the last "days" days, newest first
+func GetRecentSignupsHandler(c *fiber.Ctx) error {
+	page, limit := parsePagination(c, defaultPageSize)
+
+	days := c.QueryInt("days", intFromEnv("RECENT_SIGNUPS_DAYS", 7))
+	if days < 1 {
+		return middleware.RespondError(c, fiber.StatusBadRequest, "days must be at least 1")
+	}
+
+	query := requestDB(c).Model(&database.User{}).
+		Where("created_at >= ?", time.Now().AddDate(0, 0, -days)).
+		Session(&gorm.Session{})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch users")
+	}
+
+	var users []database.User
+	if err := query.Order("created_at DESC").Offset((page - 1) * limit).Limit(limit).Find(&users).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch users")
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
+		"users": users,
+		"total": total,
+		"page":  page,
+		"limit": limit,
+	})
+}
+
+// Get an author's books, sorted by newest, rating, or price
+func GetBooksByAuthorHandler(c *fiber.Ctx) error {
+	page, limit := parsePagination(c, intFromEnv("AUTHOR_PAGE_SIZE", 12))
+
+	// Unknown sort values fall back to newest first
+	order := "books.id DESC"
+	switch c.Query("sort") {
+	case "rating":
+		order = bookSortColumns["average_rating"] + " DESC, books.id DESC"
+	case "price":
+		order = "books.price ASC, books.id DESC"
+	}
+
+	author, err := url.PathUnescape(c.Params("author"))
+	if err != nil {
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid author")
+	}
+
+	query := requestDB(c).Model(&database.Book{}).
+		Where("LOWER(author) = LOWER(?)", author).
+		Session(&gorm.Session{})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch books")
+	}
+
+	var books []database.Book
+	if err := query.Preload("PriceTiers").
+		Joins("LEFT JOIN (?) AS review_stats ON review_stats.book_id = books.id", reviewStatsQuery(requestDB(c))).
+		Order(order).
+		Offset((page - 1) * limit).
+		Limit(limit).
+		Find(&books).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch books")
+	}
+	if err := attachReviewStats(requestDB(c), books); err != nil {
+		return middleware.Internal(err, "Failed to fetch ratings")
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
+		"books": books,
+		"total": total,
+		"page":  page,
+		"limit": limit,
+	})
+}
+
+// Add an internal admin note to a user's account
+func AddUserNoteHandler(c *fiber.Ctx) error {
+	// Parse the admin's user ID from the JWT token
+	token := c.Locals("user").(*jwt.Token)
+	claims := token.Claims.(jwt.MapClaims)
+	authorID := uint(claims["user_id"].(float64))
+
+	// Find the user the note is about
+	var user database.User
+	if err := requestDB(c).First(&user, c.Params("id")).Error; err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "User not found")
+	}
+
+	var request struct {
+		Text string `json:"text" validate:"required,max=2000"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid input data")
+	}
+
+	// Validate the input
+	if err := validate.Struct(request); err != nil {
+		return middleware.RespondValidationError(c, "Invalid input data", err)
+	}
+
+	note := database.UserNote{
+		UserID:   user.ID,
+		AuthorID: authorID,
+		Text:     request.Text,
+	}
+	if err := requestDB(c).Create(&note).Error; err != nil {
+		return middleware.Internal(err, "Failed to add note")
+	}
+
+	return middleware.RespondOK(c, note)
+}
+
+// Get the admin notes on a user's account, newest first
+func GetUserNotesHandler(c *fiber.Ctx) error {
+	var user database.User
+	if err := requestDB(c).First(&user, c.Params("id")).Error; err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "User not found")
+	}
+
+	// Include the name of the admin who wrote each note
+	var notes []struct {
+		database.UserNote
+		AuthorFirstName string `json:"author_first_name"`
+	}
+	if err := requestDB(c).Model(&database.UserNote{}).
+		Select("user_notes.*, users.first_name AS author_first_name").
+		Joins("LEFT JOIN users ON users.id = user_notes.author_id").
+		Where("user_notes.user_id = ?", user.ID).
+		Order("user_notes.created_at DESC, user_notes.id DESC").
+		Scan(&notes).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch notes")
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
+		"notes": notes,
+	})
+}
+
+// Most book IDs a single stock lookup may ask for
+const maxBatchStockIDs = 100
+
+// Get the stock of several books at once, keyed by book ID. Unknown IDs are left out.
+func BatchStockHandler(c *fiber.Ctx) error {
+	var request struct {
+		IDs []uint `json:"ids" validate:"required,min=1,max=100"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid input data")
+	}
+
+	// Validate the input
+	if err := validate.Struct(request); err != nil {
+		return middleware.RespondValidationError(c, fmt.Sprintf("Provide between 1 and %d ids", maxBatchStockIDs), err)
+	}
+
+	var rows []struct {
+		ID       uint
+		Quantity int
+	}
+	if err := requestDB(c).Model(&database.Book{}).
+		Select("id, quantity").
+		Where("id IN ?", request.IDs).
+		Scan(&rows).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch stock")
+	}
+
+	type bookStock struct {
+		Quantity int  `json:"quantity"`
+		InStock  bool `json:"in_stock"`
+	}
+	stock := make(map[uint]bookStock, len(rows))
+	for _, row := range rows {
+		stock[row.ID] = bookStock{
+			Quantity: max(row.Quantity, 0),
+			InStock:  row.Quantity > 0,
+		}
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
+		"stock": stock,
+	})
+}
+
+// Search books by title, author, genre, and description, optionally filtered by genre and price.
+// Every word in q must match at least one of the fields.
+func SearchBooksHandler(c *fiber.Ctx) error {
+	page, limit := parsePagination(c, defaultPageSize)
+
+	query := requestDB(c).Model(&database.Book{})
+	for _, term := range strings.Fields(strings.ToLower(c.Query("q"))) {
+		pattern := "%" + term + "%"
+		query = query.Where(
+			"LOWER(books.title) LIKE ? OR LOWER(books.author) LIKE ? OR LOWER(books.genre) LIKE ? OR LOWER(books.description) LIKE ?",
+			pattern, pattern, pattern, pattern,
+		)
+	}
+
+	if genre := c.Query("genre"); genre != "" {
+		query = query.Where("LOWER(books.genre) = LOWER(?)", genre)
+	}
+
+	// Parse the optional price range
+	for param, condition := range map[string]string{
+		"min_price": "books.price >= ?",
+		"max_price": "books.price <= ?",
+	} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		price, err := strconv.ParseFloat(value, 64)
+		if err != nil || price < 0 {
+			return middleware.RespondError(c, fiber.StatusBadRequest, "Invalid "+param)
+		}
+		query = query.Where(condition, price)
+	}
+	query = query.Session(&gorm.Session{})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return middleware.Internal(err, "Failed to search books")
+	}
+
+	var books []database.Book
+	if err := query.Preload("PriceTiers").
+		Order("books.id").
+		Offset((page - 1) * limit).
+		Limit(limit).
+		Find(&books).Error; err != nil {
+		return middleware.Internal(err, "Failed to search books")
+	}
+	if err := attachReviewStats(requestDB(c), books); err != nil {
+		return middleware.Internal(err, "Failed to fetch ratings")
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
+		"books": books,
+		"total": total,
+		"page":  page,
+		"limit": limit,
+	})
+}
+
+// Get books that have never been reviewed, oldest first
+func GetUnreviewedBooksHandler(c *fiber.Ctx) error {
+	page, limit := parsePagination(c, defaultPageSize)
+
+	query := requestDB(c).Model(&database.Book{}).
+		Joins("LEFT JOIN reviews ON reviews.book_id = books.id AND reviews.deleted_at IS NULL").
+		Where("reviews.id IS NULL").
+		Session(&gorm.Session{})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch books")
+	}
+
+	var books []database.Book
+	if err := query.
+		Order("books.id").
+		Offset((page - 1) * limit).
+		Limit(limit).
+		Find(&books).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch books")
+	}
+
+	// Reset any stale stored rating, since none of these books have reviews left
+	if err := attachReviewStats(requestDB(c), books); err != nil {
+		return middleware.Internal(err, "Failed to fetch ratings")
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
+		"books": books,
+		"total": total,
+		"page":  page,
+		"limit": limit,
+	})
+}
+
+// Get the reviews a user has written, with book titles, newest first
+func GetUserReviewsHandler(c *fiber.Ctx) error {
+	var user database.User
+	if err := requestDB(c).First(&user, c.Params("id")).Error; err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "User not found")
+	}
+
+	page, limit := parsePagination(c, defaultPageSize)
+	query := requestDB(c).Model(&database.Review{}).Where("reviews.user_id = ?", user.ID).Session(&gorm.Session{})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch reviews")
+	}
+
+	// Include the book title, even for books that have since been deleted
+	var reviews []struct {
+		database.Review
+		BookTitle string `json:"book_title"`
+	}
+	if err := query.
+		Select("reviews.*, books.title AS book_title").
+		Joins("LEFT JOIN books ON books.id = reviews.book_id").
+		Order("reviews.created_at DESC, reviews.id DESC").
+		Offset((page - 1) * limit).
+		Limit(limit).
+		Scan(&reviews).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch reviews")
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
+		"reviews": reviews,
+		"total":   total,
+		"page":    page,
+		"limit":   limit,
+	})
+}
+
+// A single entry in a user's activity timeline
+type activityEvent struct {
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	BookID uint      `json:"book_id,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// Get a user's signups, logins, reviews, cart changes, and admin notes as one timeline, newest first
+func GetUserActivityHandler(c *fiber.Ctx) error {
+	page, limit := parsePagination(c, defaultPageSize)
+
+	var user database.User
+	if err := requestDB(c).First(&user, c.Params("id")).Error; err != nil {
+		return middleware.RespondError(c, fiber.StatusNotFound, "User not found")
+	}
+
+	events := []activityEvent{{Type: "signup", Time: user.CreatedAt}}
+	if user.LastLoginAt != nil {
+		events = append(events, activityEvent{Type: "login", Time: *user.LastLoginAt})
+	}
+
+	var reviews []database.Review
+	if err := requestDB(c).Where("user_id = ?", user.ID).Find(&reviews).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch activity")
+	}
+	for _, review := range reviews {
+		events = append(events, activityEvent{
+			Type:   "review",
+			Time:   review.CreatedAt,
+			BookID: review.BookID,
+			Detail: strconv.Itoa(review.Rating) + " stars",
+		})
+	}
+
+	// Removed cart items are soft-deleted, so include them to show both the add and the removal
+	var cartItems []database.CartItem
+	if err := requestDB(c).Unscoped().Where("user_id = ?", user.ID).Find(&cartItems).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch activity")
+	}
+	for _, item := range cartItems {
+		events = append(events, activityEvent{Type: "cart_add", Time: item.CreatedAt, BookID: item.BookID})
+		if item.DeletedAt.Valid {
+			events = append(events, activityEvent{Type: "cart_remove", Time: item.DeletedAt.Time, BookID: item.BookID})
+		}
+	}
+
+	var notes []database.UserNote
+	if err := requestDB(c).Where("user_id = ?", user.ID).Find(&notes).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch activity")
+	}
+	for _, note := range notes {
+		events = append(events, activityEvent{Type: "note", Time: note.CreatedAt, Detail: note.Text})
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.After(events[j].Time)
+	})
+
+	total := len(events)
+	start := (page - 1) * limit
+	if start > total {
+		start = total
+	}
+	end := start + limit
+	if end > total {
+		end = total
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
+		"events": events[start:end],
+		"total":  total,
+		"page":   page,
+		"limit":  limit,
+	})
+}
+
+// Get the books with fewer copies than the "threshold" query parameter, lowest stock first, with
+// how often each one is in users' carts. Also sums up stock across the whole catalog.
+func GetInventoryReportHandler(c *fiber.Ctx) error {
+	threshold := c.QueryInt("threshold", 5)
+	if threshold < 0 {
+		return middleware.RespondError(c, fiber.StatusBadRequest, "threshold must be at least 0")
+	}
+
+	var summary struct {
+		Titles     int64
+		Units      int64
+		OutOfStock int64
+	}
+	if err := requestDB(c).Model(&database.Book{}).
+		Select("COUNT(*) AS titles, " +
+			"COALESCE(SUM(CASE WHEN quantity > 0 THEN quantity ELSE 0 END), 0) AS units, " +
+			"COUNT(CASE WHEN quantity <= 0 THEN 1 END) AS out_of_stock").
+		Scan(&summary).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch inventory totals")
+	}
+
+	// Load the books themselves so AfterFind derives their needs_reorder and pre_order_badge flags
+	var lowStock []database.Book
+	if err := requestDB(c).
+		Where("quantity < ?", threshold).
+		Order("quantity ASC, id").
+		Find(&lowStock).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch low-stock books")
+	}
+	if err := attachReviewStats(requestDB(c), lowStock); err != nil {
+		return middleware.Internal(err, "Failed to fetch ratings")
+	}
+
+	// Count each book's cart lines and the copies they ask for, to anticipate demand
+	ids := make([]uint, len(lowStock))
+	for i, book := range lowStock {
+		ids[i] = book.ID
+	}
+	var demand []struct {
+		BookID       uint
+		InCarts      int
+		UnitsInCarts int
+	}
+	if len(ids) > 0 {
+		if err := requestDB(c).Model(&database.CartItem{}).
+			Select("book_id, COUNT(*) AS in_carts, COALESCE(SUM(quantity), 0) AS units_in_carts").
+			Where("book_id IN ?", ids).
+			Group("book_id").
+			Scan(&demand).Error; err != nil {
+			return middleware.Internal(err, "Failed to fetch cart demand")
+		}
+	}
+
+	byBook := make(map[uint]int, len(demand))
+	for i, d := range demand {
+		byBook[d.BookID] = i
+	}
+	type inventoryBook struct {
+		database.Book
+		InCarts      int `json:"in_carts"`
+		UnitsInCarts int `json:"units_in_carts"`
+	}
+	books := make([]inventoryBook, len(lowStock))
+	for i, book := range lowStock {
+		books[i].Book = book
+		if j, ok := byBook[book.ID]; ok {
+			books[i].InCarts = demand[j].InCarts
+			books[i].UnitsInCarts = demand[j].UnitsInCarts
+		}
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
+		"threshold":           threshold,
+		"books":               books,
+		"total_titles":        summary.Titles,
+		"total_units":         summary.Units,
+		"out_of_stock_titles": summary.OutOfStock,
+	})
+}
+
+// Get books with no stock left, most in-demand first, optionally filtered by genre
+func GetOutOfStockHandler(c *fiber.Ctx) error {
+	page, limit := parsePagination(c, defaultPageSize)
+
+	// Releasing pre-orders can take stock below zero
+	query := requestDB(c).Model(&database.Book{}).Where("books.quantity <= 0")
+	if genre := c.Query("genre"); genre != "" {
+		query = query.Where("LOWER(books.genre) = LOWER(?)", genre)
+	}
+	query = query.Session(&gorm.Session{})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch books")
+	}
+
+	// Demand is the number of users who have the book in their cart
+	var ranked []struct {
+		ID     uint
+		Demand int
+	}
+	if err := query.
+		Select("books.id, COUNT(DISTINCT cart_items.user_id) AS demand").
+		Joins("LEFT JOIN cart_items ON cart_items.book_id = books.id AND cart_items.deleted_at IS NULL").
+		Group("books.id").
+		Order("demand DESC, books.id").
+		Offset((page - 1) * limit).
+		Limit(limit).
+		Scan(&ranked).Error; err != nil {
+		return middleware.Internal(err, "Failed to fetch books")
+	}
+
+	// Load the books themselves so AfterFind derives their flags, then add their review stats
+	ids := make([]uint, len(ranked))
+	for i, rank := range ranked {
+		ids[i] = rank.ID
+	}
+	var found []database.Book
+	if len(ids) > 0 {
+		if err := requestDB(c).Where("id IN ?", ids).Find(&found).Error; err != nil {
+			return middleware.Internal(err, "Failed to fetch books")
+		}
+	}
+	if err := attachReviewStats(requestDB(c), found); err != nil {
+		return middleware.Internal(err, "Failed to fetch ratings")
+	}
+
+	byID := make(map[uint]database.Book, len(found))
+	for _, book := range found {
+		byID[book.ID] = book
+	}
+	type outOfStockBook struct {
+		database.Book
+		Demand int `json:"demand"`
+	}
+	books := make([]outOfStockBook, 0, len(ranked))
+	for _, rank := range ranked {
+		if book, ok := byID[rank.ID]; ok {
+			books = append(books, outOfStockBook{Book: book, Demand: rank.Demand})
+		}
+	}
+
+	return middleware.RespondOK(c, fiber.Map{
+		"books": books,
+		"total": total,
+		"page":  page,
+		"limit": limit,
 	})
 }
@@ -0,0 +1,3228 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/middleware"
+)
+
+// testDSN names the test's in-memory database. Readers don't take table locks, so a test can
+// commit from a second connection while a request's transaction is open, like another request
+// would on Postgres.
+func testDSN(t *testing.T) string {
+	return fmt.Sprintf("file:%s?mode=memory&cache=shared&_pragma=read_uncommitted(1)", t.Name())
+}
+
+// setupTestApp points the database package at a fresh in-memory database and
+// returns an app with all routes registered
+func setupTestApp(t *testing.T) *fiber.App {
+	t.Helper()
+
+	os.Setenv("JWT_SECRET", "test-secret")
+
+	db, err := gorm.Open(sqlite.Open(testDSN(t)), &gorm.Config{
+		Logger:         logger.Default.LogMode(logger.Silent),
+		TranslateError: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+
+	// SQLite can deadlock two concurrent write transactions instead of making one wait, so
+	// queue them on a single connection like Postgres would queue them on a row lock
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+
+	database.SetDB(db)
+	database.AutoMigrateModels(db)
+
+	t.Cleanup(func() {
+		database.CloseDB()
+	})
+
+	app := fiber.New(fiber.Config{
+		ErrorHandler: middleware.ErrorHandler,
+		BodyLimit:    UploadBodyLimit(),
+	})
+	DefineRoutes(app)
+	return app
+}
+
+// testPassword is the plain-text password of every user created by createTestUser
+const testPassword = "password123"
+
+// createTestUser stores a user with the given role and returns it with a valid token
+func createTestUser(t *testing.T, email string, role database.UserRole) (database.User, string) {
+	t.Helper()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+
+	user := database.User{
+		FirstName: "Test",
+		LastName:  "User",
+		Email:     email,
+		Password:  hashedPassword,
+		Role:      role,
+	}
+	if err := database.GetDB().Create(&user).Error; err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	token, _, err := createSession(database.GetDB(), user.ID)
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+
+	return user, token
+}
+
+// createTestBook stores a book and returns it
+func createTestBook(t *testing.T, book database.Book) database.Book {
+	t.Helper()
+
+	if err := database.GetDB().Create(&book).Error; err != nil {
+		t.Fatalf("Failed to create book: %v", err)
+	}
+	return book
+}
+
+// doRequest sends a request to the app and decodes the response envelope
+func doRequest(t *testing.T, app *fiber.App, method, path, token string, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("Failed to encode body: %v", err)
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+
+	var envelope struct {
+		Success bool                   `json:"success"`
+		Data    interface{}            `json:"data"`
+		Error   map[string]interface{} `json:"error"`
+	}
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		t.Fatalf("Failed to decode response %q: %v", raw, err)
+	}
+
+	// Successful requests return their data, failed ones the error merged with any data
+	result := map[string]interface{}{}
+	if data, ok := envelope.Data.(map[string]interface{}); ok {
+		result = data
+	}
+	for key, value := range envelope.Error {
+		result[key] = value
+	}
+	return resp.StatusCode, result
+}
+
+// Post a review of the book for each rating through the API, each from a new reviewer
+func postReviews(t *testing.T, app *fiber.App, book database.Book, ratings ...int) {
+	t.Helper()
+
+	for _, rating := range ratings {
+		var count int64
+		database.GetDB().Model(&database.User{}).Count(&count)
+		_, token := createTestUser(t, fmt.Sprintf("reviewer%d@example.com", count), database.UserRoleStandard)
+		if status, body := doRequest(t, app, "POST", fmt.Sprintf("/user/book/%d/reviews", book.ID), token, fiber.Map{"rating": rating}); status != fiber.StatusOK {
+			t.Fatalf("Failed to post review: %d %v", status, body)
+		}
+	}
+}
+
+func TestGetReviewsHandler_DateRange(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	book := createTestBook(t, database.Book{Title: "Dune", Author: "Frank Herbert", Price: 10})
+
+	day := time.Date(2023, 9, 10, 12, 0, 0, 0, time.UTC)
+	for i, createdAt := range []time.Time{day.AddDate(0, 0, -1), day, day.AddDate(0, 0, 1)} {
+		reviewer, _ := createTestUser(t, fmt.Sprintf("reader%d@example.com", i), database.UserRoleStandard)
+		review := database.Review{BookID: book.ID, UserID: reviewer.ID, Rating: 4, Comment: "Good"}
+		review.CreatedAt = createdAt
+		if err := database.GetDB().Create(&review).Error; err != nil {
+			t.Fatalf("Failed to create review: %v", err)
+		}
+	}
+
+	status, body := doRequest(t, app, "GET", "/admin/reviews?from=2023-09-10&to=2023-09-10", adminToken, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+
+	if body["total"].(float64) != 1 {
+		t.Errorf("Expected 1 review in the window, but got %v", body["total"])
+	}
+
+	reviews := body["reviews"].([]interface{})
+	if len(reviews) != 1 {
+		t.Fatalf("Expected 1 review returned, but got %d", len(reviews))
+	}
+
+	review := reviews[0].(map[string]interface{})
+	if review["book_title"] != "Dune" {
+		t.Errorf("Expected book title Dune, but got %v", review["book_title"])
+	}
+	if review["email"] != "reader1@example.com" {
+		t.Errorf("Expected reviewer email, but got %v", review["email"])
+	}
+}
+
+func TestGetReviewsHandler_InvalidDate(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+
+	status, _ := doRequest(t, app, "GET", "/admin/reviews?from=10-09-2023", adminToken, nil)
+	if status != fiber.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", status)
+	}
+}
+
+func TestAddToCartHandler_PriceTier(t *testing.T) {
+	app := setupTestApp(t)
+
+	book := createTestBook(t, database.Book{
+		Title:    "Bulk Book",
+		Price:    20,
+		Quantity: 100,
+		PriceTiers: []database.PriceTier{
+			{MinQuantity: 10, DiscountPercent: 5},
+		},
+	})
+
+	tests := []struct {
+		email    string
+		quantity uint
+		subtotal float64
+	}{
+		{"nine@example.com", 9, 180},
+		{"ten@example.com", 10, 190},
+	}
+
+	for _, tt := range tests {
+		_, token := createTestUser(t, tt.email, database.UserRoleStandard)
+
+		status, body := doRequest(t, app, "POST", "/user/cart", token, fiber.Map{
+			"book_id":  book.ID,
+			"quantity": tt.quantity,
+		})
+		if status != fiber.StatusOK {
+			t.Fatalf("Expected status 200, but got %d: %v", status, body)
+		}
+
+		if body["subtotal"].(float64) != tt.subtotal {
+			t.Errorf("Expected subtotal %v for %d copies, but got %v", tt.subtotal, tt.quantity, body["subtotal"])
+		}
+	}
+
+	_, token := createTestUser(t, "viewer@example.com", database.UserRoleStandard)
+	status, body := doRequest(t, app, "GET", fmt.Sprintf("/user/book/%d", book.ID), token, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", status)
+	}
+	if tiers := body["price_tiers"].([]interface{}); len(tiers) != 1 {
+		t.Errorf("Expected 1 price tier on the book, but got %d", len(tiers))
+	}
+}
+
+func TestSeedReviewsHandler_RespectsUniqueness(t *testing.T) {
+	t.Setenv("APP_ENV", "development")
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	reader, _ := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	createTestUser(t, "other@example.com", database.UserRoleStandard)
+
+	var books []database.Book
+	for _, title := range []string{"First", "Second", "Third"} {
+		books = append(books, createTestBook(t, database.Book{Title: title, Price: 10}))
+	}
+
+	existing := database.Review{BookID: books[0].ID, UserID: reader.ID, Rating: 5, Comment: "Keep me"}
+	if err := database.GetDB().Create(&existing).Error; err != nil {
+		t.Fatalf("Failed to create review: %v", err)
+	}
+
+	status, body := doRequest(t, app, "POST", "/admin/dev/seed-reviews", adminToken, fiber.Map{"count": 100})
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+	if body["created"].(float64) != 8 {
+		t.Errorf("Expected 8 seeded reviews, but got %v", body["created"])
+	}
+
+	var duplicates int64
+	database.GetDB().Raw("SELECT COUNT(*) FROM (SELECT user_id, book_id FROM reviews GROUP BY user_id, book_id HAVING COUNT(*) > 1) d").Scan(&duplicates)
+	if duplicates != 0 {
+		t.Errorf("Expected no duplicate user/book reviews, but found %d", duplicates)
+	}
+
+	// Seeding again has nothing left to create
+	_, body = doRequest(t, app, "POST", "/admin/dev/seed-reviews", adminToken, fiber.Map{"count": 100})
+	if body["created"].(float64) != 0 {
+		t.Errorf("Expected no reviews on the second seed, but got %v", body["created"])
+	}
+
+	var book database.Book
+	database.GetDB().First(&book, books[1].ID)
+	if book.AverageRating < 1 || book.AverageRating > 5 {
+		t.Errorf("Expected a recomputed average rating, but got %v", book.AverageRating)
+	}
+}
+
+func TestGetReorderListHandler(t *testing.T) {
+	t.Setenv("REORDER_THRESHOLD", "5")
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+
+	custom := 20
+	lowBook := createTestBook(t, database.Book{Title: "Low", Quantity: 2})
+	postReviews(t, app, lowBook, 5)
+	createTestBook(t, database.Book{Title: "Plenty", Quantity: 50})
+	createTestBook(t, database.Book{Title: "Custom", Quantity: 10, ReorderThreshold: &custom})
+
+	status, body := doRequest(t, app, "GET", "/admin/books/reorder", adminToken, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+
+	books := body["books"].([]interface{})
+	if len(books) != 2 {
+		t.Fatalf("Expected 2 books to reorder, but got %d", len(books))
+	}
+
+	low := books[0].(map[string]interface{})
+	if low["title"] != "Low" || low["needs_reorder"] != true {
+		t.Errorf("Expected Low to be flagged first, but got %v", low)
+	}
+	if low["review_count"].(float64) != 1 || low["average_rating"].(float64) != 5 {
+		t.Errorf("Expected Low's live review stats, but got %v and %v", low["review_count"], low["average_rating"])
+	}
+	if low["suggested_quantity"].(float64) != 8 {
+		t.Errorf("Expected a suggested quantity of 8, but got %v", low["suggested_quantity"])
+	}
+
+	if custom := books[1].(map[string]interface{}); custom["title"] != "Custom" {
+		t.Errorf("Expected Custom to use its own threshold, but got %v", custom["title"])
+	}
+}
+
+func TestMergeBooksHandler_OverlappingReviewers(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	both, _ := createTestUser(t, "both@example.com", database.UserRoleStandard)
+	single, _ := createTestUser(t, "single@example.com", database.UserRoleStandard)
+
+	target := createTestBook(t, database.Book{Title: "Original", ISBN: "123", Price: 10, Quantity: 3})
+	source := createTestBook(t, database.Book{Title: "Duplicate", ISBN: "123", Price: 10, Quantity: 4})
+
+	now := time.Now()
+	reviews := []database.Review{
+		{BookID: target.ID, UserID: both.ID, Rating: 2, Comment: "Older"},
+		{BookID: source.ID, UserID: both.ID, Rating: 5, Comment: "Newer"},
+		{BookID: source.ID, UserID: single.ID, Rating: 4, Comment: "Only one"},
+	}
+	for i := range reviews {
+		reviews[i].CreatedAt = now.Add(time.Duration(i) * time.Hour)
+		if err := database.GetDB().Create(&reviews[i]).Error; err != nil {
+			t.Fatalf("Failed to create review: %v", err)
+		}
+	}
+
+	cartItem := database.CartItem{UserID: single.ID, BookID: source.ID, Quantity: 2, Subtotal: 20}
+	if err := database.GetDB().Create(&cartItem).Error; err != nil {
+		t.Fatalf("Failed to create cart item: %v", err)
+	}
+
+	status, body := doRequest(t, app, "POST", "/admin/books/merge", adminToken, fiber.Map{
+		"source_id": source.ID,
+		"target_id": target.ID,
+	})
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+
+	if body["quantity"].(float64) != 7 {
+		t.Errorf("Expected combined stock of 7, but got %v", body["quantity"])
+	}
+
+	var merged []database.Review
+	database.GetDB().Where("book_id = ?", target.ID).Order("user_id").Find(&merged)
+	if len(merged) != 2 {
+		t.Fatalf("Expected 2 reviews on the target, but got %d", len(merged))
+	}
+	for _, review := range merged {
+		if review.UserID == both.ID && review.Comment != "Newer" {
+			t.Errorf("Expected the newer review to be kept, but got %q", review.Comment)
+		}
+	}
+
+	var movedItem database.CartItem
+	database.GetDB().First(&movedItem, cartItem.ID)
+	if movedItem.BookID != target.ID {
+		t.Errorf("Expected cart item to point at the target, but got book %d", movedItem.BookID)
+	}
+
+	if err := database.GetDB().First(&database.Book{}, source.ID).Error; err != gorm.ErrRecordNotFound {
+		t.Errorf("Expected source book to be soft-deleted, but got %v", err)
+	}
+}
+
+func TestGetReviewsHandler_Search(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	reviewer, _ := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	first := createTestBook(t, database.Book{Title: "First", Price: 10})
+	second := createTestBook(t, database.Book{Title: "Second", Price: 10})
+
+	database.GetDB().Create(&database.Review{BookID: first.ID, UserID: reviewer.ID, Rating: 1, Comment: "My copy arrived DEFECTIVE"})
+	database.GetDB().Create(&database.Review{BookID: second.ID, UserID: reviewer.ID, Rating: 5, Comment: "Perfect condition"})
+
+	status, body := doRequest(t, app, "GET", "/admin/reviews?q=defective", adminToken, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+
+	reviews := body["reviews"].([]interface{})
+	if len(reviews) != 1 {
+		t.Fatalf("Expected 1 matching review, but got %d", len(reviews))
+	}
+	if title := reviews[0].(map[string]interface{})["book_title"]; title != "First" {
+		t.Errorf("Expected the review of First, but got %v", title)
+	}
+
+	// An empty query returns every review
+	_, body = doRequest(t, app, "GET", "/admin/reviews?q=", adminToken, nil)
+	if body["total"].(float64) != 2 {
+		t.Errorf("Expected 2 reviews for an empty query, but got %v", body["total"])
+	}
+}
+
+func TestDeactivateInactiveUsers(t *testing.T) {
+	app := setupTestApp(t)
+
+	stale, staleToken := createTestUser(t, "stale@example.com", database.UserRoleStandard)
+	recent, recentToken := createTestUser(t, "recent@example.com", database.UserRoleStandard)
+	admin, _ := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+
+	longAgo := time.Now().AddDate(-3, 0, 0)
+	yesterday := time.Now().AddDate(0, 0, -1)
+	database.GetDB().Model(&stale).UpdateColumn("last_login_at", longAgo)
+	database.GetDB().Model(&recent).UpdateColumn("last_login_at", yesterday)
+	database.GetDB().Model(&admin).UpdateColumn("last_login_at", longAgo)
+
+	count, err := database.DeactivateInactiveUsers(time.Now().AddDate(-2, 0, 0))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 deactivated user, but got %d", count)
+	}
+
+	for _, tt := range []struct {
+		user   database.User
+		active bool
+	}{{stale, false}, {recent, true}, {admin, true}} {
+		var user database.User
+		database.GetDB().First(&user, tt.user.ID)
+		if user.Active != tt.active {
+			t.Errorf("Expected %s active=%v, but got %v", user.Email, tt.active, user.Active)
+		}
+	}
+
+	// Deactivated accounts lose their sessions
+	if status, _ := doRequest(t, app, "GET", fmt.Sprintf("/user/profile/%d", stale.ID), staleToken, nil); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected the deactivated account's token to be revoked, but got %d", status)
+	}
+	if status, _ := doRequest(t, app, "GET", fmt.Sprintf("/user/profile/%d", recent.ID), recentToken, nil); status != fiber.StatusOK {
+		t.Errorf("Expected the active account's token to keep working, but got %d", status)
+	}
+
+	// Logging in again reactivates the stale account
+	status, body := doRequest(t, app, "POST", "/login", "", fiber.Map{
+		"email":    "stale@example.com",
+		"password": testPassword,
+	})
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+	if body["notice"] == nil {
+		t.Error("Expected a reactivation notice, but got none")
+	}
+
+	var user database.User
+	database.GetDB().First(&user, stale.ID)
+	if !user.Active {
+		t.Error("Expected the account to be reactivated after login")
+	}
+}
+
+func TestLoginHandler_UpdatesLastLoginAt(t *testing.T) {
+	app := setupTestApp(t)
+
+	user, _ := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+
+	before := time.Now().Add(-time.Second)
+	status, body := doRequest(t, app, "POST", "/login", "", fiber.Map{
+		"email":    "reader@example.com",
+		"password": testPassword,
+	})
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+
+	var stored database.User
+	database.GetDB().First(&stored, user.ID)
+	if stored.LastLoginAt == nil || stored.LastLoginAt.Before(before) {
+		t.Fatalf("Expected last login to be recorded, but got %v", stored.LastLoginAt)
+	}
+
+	// A failed login leaves the timestamp untouched
+	doRequest(t, app, "POST", "/login", "", fiber.Map{
+		"email":    "reader@example.com",
+		"password": "wrong-password",
+	})
+	var afterFailure database.User
+	database.GetDB().First(&afterFailure, user.ID)
+	if !afterFailure.LastLoginAt.Equal(*stored.LastLoginAt) {
+		t.Errorf("Expected a failed login not to change the timestamp")
+	}
+
+	// Admins can see the timestamp in the user view
+	_, body = doRequest(t, app, "GET", fmt.Sprintf("/admin/user/%d", user.ID), adminToken, nil)
+	if body["last_login_at"] == nil {
+		t.Error("Expected last_login_at in the admin user view")
+	}
+}
+
+func TestBulkSetFeaturedHandler_Genre(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	createTestBook(t, database.Book{Title: "It", Genre: "Horror"})
+	createTestBook(t, database.Book{Title: "Dracula", Genre: "Horror"})
+	createTestBook(t, database.Book{Title: "Emma", Genre: "Romance"})
+
+	countFeatured := func() int64 {
+		var count int64
+		database.GetDB().Model(&database.Book{}).Where("featured = ?", true).Count(&count)
+		return count
+	}
+
+	status, body := doRequest(t, app, "PUT", "/admin/books/featured", adminToken, fiber.Map{
+		"genre":    "Horror",
+		"featured": true,
+	})
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+	if body["updated"].(float64) != 2 {
+		t.Errorf("Expected 2 books updated, but got %v", body["updated"])
+	}
+	if count := countFeatured(); count != 2 {
+		t.Errorf("Expected 2 featured books, but got %d", count)
+	}
+
+	_, body = doRequest(t, app, "PUT", "/admin/books/featured", adminToken, fiber.Map{
+		"genre":    "Horror",
+		"featured": false,
+	})
+	if body["updated"].(float64) != 2 {
+		t.Errorf("Expected 2 books updated, but got %v", body["updated"])
+	}
+	if count := countFeatured(); count != 0 {
+		t.Errorf("Expected no featured books, but got %d", count)
+	}
+
+	// A request without any filter is rejected
+	status, _ = doRequest(t, app, "PUT", "/admin/books/featured", adminToken, fiber.Map{"featured": true})
+	if status != fiber.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", status)
+	}
+}
+
+func TestCreateBookHandler_NormalizesGenre(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+
+	for i, genre := range []string{"horror", "Horror", " HORROR "} {
+		status, body := doRequest(t, app, "POST", "/admin/book", adminToken, fiber.Map{
+			"title": fmt.Sprintf("Book %d", i),
+			"genre": genre,
+		})
+		if status != fiber.StatusOK {
+			t.Fatalf("Expected status 200, but got %d: %v", status, body)
+		}
+	}
+
+	var genres []string
+	database.GetDB().Model(&database.Book{}).Distinct().Pluck("genre", &genres)
+	if len(genres) != 1 || genres[0] != "Horror" {
+		t.Errorf("Expected a single Horror genre, but got %v", genres)
+	}
+}
+
+func TestNormalizeGenresHandler(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	createTestBook(t, database.Book{Title: "One", Genre: "science  FICTION"})
+	createTestBook(t, database.Book{Title: "Two", Genre: "Science Fiction"})
+
+	status, body := doRequest(t, app, "POST", "/admin/books/normalize-genres", adminToken, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+	if body["updated"].(float64) != 1 {
+		t.Errorf("Expected 1 book updated, but got %v", body["updated"])
+	}
+
+	var genres []string
+	database.GetDB().Model(&database.Book{}).Distinct().Pluck("genre", &genres)
+	if len(genres) != 1 || genres[0] != "Science Fiction" {
+		t.Errorf("Expected a single Science Fiction genre, but got %v", genres)
+	}
+}
+
+func TestRequestDB_CancelledContextAbortsQuery(t *testing.T) {
+	app := setupTestApp(t)
+	createTestBook(t, database.Book{Title: "Dune"})
+
+	c := app.AcquireCtx(&fasthttp.RequestCtx{})
+	defer app.ReleaseCtx(c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.SetUserContext(ctx)
+
+	var books []database.Book
+	err := requestDB(c).Find(&books).Error
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the query to be cancelled, but got %v", err)
+	}
+}
+
+func TestGetStorefrontHandler_Shape(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	dracula := createTestBook(t, database.Book{Title: "Dracula", Genre: "Horror", Quantity: 3})
+	it := createTestBook(t, database.Book{Title: "It", Genre: "Horror", Quantity: 0})
+	carrie := createTestBook(t, database.Book{Title: "Carrie", Genre: "Horror", Quantity: 2})
+	emma := createTestBook(t, database.Book{Title: "Emma", Genre: "Romance", Quantity: 5})
+	postReviews(t, app, dracula, 4, 5)
+	postReviews(t, app, it, 5)
+	postReviews(t, app, carrie, 3)
+	postReviews(t, app, emma, 4)
+
+	status, body := doRequest(t, app, "GET", "/user/storefront?genres=2&per_genre=2", token, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+
+	shelves := body["shelves"].([]interface{})
+	if len(shelves) != 2 {
+		t.Fatalf("Expected 2 shelves, but got %d", len(shelves))
+	}
+
+	horror := shelves[0].(map[string]interface{})
+	if horror["genre"] != "Horror" {
+		t.Errorf("Expected Horror first, but got %v", horror["genre"])
+	}
+	horrorBooks := horror["books"].([]interface{})
+	if len(horrorBooks) != 2 {
+		t.Fatalf("Expected 2 Horror books, but got %d", len(horrorBooks))
+	}
+	top := horrorBooks[0].(map[string]interface{})
+	if top["title"] != "It" || top["out_of_stock"] != true || top["average_rating"] != float64(5) {
+		t.Errorf("Expected It first and flagged out of stock, but got %v", top)
+	}
+
+	romance := shelves[1].(map[string]interface{})
+	if books := romance["books"].([]interface{}); romance["genre"] != "Romance" || len(books) != 1 {
+		t.Errorf("Expected a Romance shelf with 1 book, but got %v", romance)
+	}
+}
+
+func TestGetRecentSignupsHandler_Window(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	old, _ := createTestUser(t, "old@example.com", database.UserRoleStandard)
+	older, _ := createTestUser(t, "older@example.com", database.UserRoleStandard)
+	createTestUser(t, "new@example.com", database.UserRoleStandard)
+
+	database.GetDB().Model(&old).UpdateColumn("created_at", time.Now().AddDate(0, 0, -10))
+	database.GetDB().Model(&older).UpdateColumn("created_at", time.Now().AddDate(0, 0, -40))
+
+	status, body := doRequest(t, app, "GET", "/admin/users/recent?days=30", adminToken, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+	if body["total"].(float64) != 3 {
+		t.Errorf("Expected 3 signups in the last 30 days, but got %v", body["total"])
+	}
+
+	users := body["users"].([]interface{})
+	if last := users[len(users)-1].(map[string]interface{}); last["email"] != "old@example.com" {
+		t.Errorf("Expected the oldest signup last, but got %v", last["email"])
+	}
+	for _, user := range users {
+		if _, ok := user.(map[string]interface{})["password"]; ok {
+			t.Error("Expected passwords to be stripped from the response")
+		}
+	}
+}
+
+func TestGetBooksByAuthorHandler_Sort(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	middling := createTestBook(t, database.Book{Title: "Middling", Author: "Ursula K. Le Guin", Price: 9})
+	best := createTestBook(t, database.Book{Title: "Best", Author: "Ursula K. Le Guin", Price: 15})
+	worst := createTestBook(t, database.Book{Title: "Worst", Author: "Ursula K. Le Guin", Price: 12})
+	other := createTestBook(t, database.Book{Title: "Other", Author: "Someone Else"})
+	postReviews(t, app, middling, 3, 4)
+	postReviews(t, app, best, 5)
+	postReviews(t, app, worst, 2)
+	postReviews(t, app, other, 5)
+
+	titles := func(body map[string]interface{}) []string {
+		var result []string
+		for _, book := range body["books"].([]interface{}) {
+			result = append(result, book.(map[string]interface{})["title"].(string))
+		}
+		return result
+	}
+
+	status, body := doRequest(t, app, "GET", "/user/author/ursula%20k.%20le%20guin/books?sort=rating", token, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+	if got := fmt.Sprint(titles(body)); got != "[Best Middling Worst]" {
+		t.Errorf("Expected books by rating, but got %s", got)
+	}
+	if body["limit"].(float64) != 12 {
+		t.Errorf("Expected the author page size, but got %v", body["limit"])
+	}
+
+	// An invalid sort falls back to newest first
+	_, body = doRequest(t, app, "GET", "/user/author/Ursula%20K.%20Le%20Guin/books?sort=bogus", token, nil)
+	if got := fmt.Sprint(titles(body)); got != "[Worst Best Middling]" {
+		t.Errorf("Expected newest books first, but got %s", got)
+	}
+
+	// New reviews change the ranking straight away
+	postReviews(t, app, best, 1, 1)
+	_, body = doRequest(t, app, "GET", "/user/author/ursula%20k.%20le%20guin/books?sort=rating", token, nil)
+	if got := fmt.Sprint(titles(body)); got != "[Middling Best Worst]" {
+		t.Errorf("Expected Best to drop after low ratings, but got %s", got)
+	}
+}
+
+func TestRegisterHandler_ConcurrentSameEmail(t *testing.T) {
+	app := setupTestApp(t)
+
+	// Both accounts can't exist at once
+	createTestUser(t, "taken@example.com", database.UserRoleStandard)
+	if err := database.GetDB().Create(&database.User{Email: "Taken@Example.com"}).Error; err == nil {
+		t.Fatal("Expected the unique index to reject a second account with the same email")
+	}
+
+	const requests = 2
+	statuses := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			payload, _ := json.Marshal(fiber.Map{
+				"firstname": "Double",
+				"lastname":  "Click",
+				"email":     "twice@example.com",
+				"password":  "a-strong-password",
+				"role":      "user",
+			})
+			req := httptest.NewRequest("POST", "/register", bytes.NewReader(payload))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	counts := map[int]int{}
+	for i := 0; i < requests; i++ {
+		counts[<-statuses]++
+	}
+	if counts[fiber.StatusOK] != 1 || counts[fiber.StatusConflict] != 1 {
+		t.Errorf("Expected one registration to succeed and one to conflict, but got %v", counts)
+	}
+
+	var count int64
+	database.GetDB().Model(&database.User{}).Where("email = ?", "twice@example.com").Count(&count)
+	if count != 1 {
+		t.Errorf("Expected a single account, but got %d", count)
+	}
+}
+
+func TestRegisterHandler_EmailAliases(t *testing.T) {
+	register := func(app *fiber.App, email string) int {
+		status, _ := doRequest(t, app, "POST", "/register", "", fiber.Map{
+			"firstname": "Alias",
+			"lastname":  "Tester",
+			"email":     email,
+			"password":  "a-strong-password",
+			"role":      "user",
+		})
+		return status
+	}
+
+	t.Run("enforced", func(t *testing.T) {
+		t.Setenv("EMAIL_ALIAS_CANONICALIZATION", "true")
+		app := setupTestApp(t)
+
+		if status := register(app, "a.b+x@gmail.com"); status != fiber.StatusOK {
+			t.Fatalf("Expected the first registration to succeed, but got %d", status)
+		}
+		if status := register(app, "ab@gmail.com"); status != fiber.StatusConflict {
+			t.Errorf("Expected the alias to conflict, but got %d", status)
+		}
+
+		var user database.User
+		database.GetDB().First(&user)
+		if user.Email != "a.b+x@gmail.com" {
+			t.Errorf("Expected the original email to be stored, but got %s", user.Email)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("EMAIL_ALIAS_CANONICALIZATION", "false")
+		app := setupTestApp(t)
+
+		if status := register(app, "a.b+x@gmail.com"); status != fiber.StatusOK {
+			t.Fatalf("Expected the first registration to succeed, but got %d", status)
+		}
+		if status := register(app, "ab@gmail.com"); status != fiber.StatusOK {
+			t.Errorf("Expected a distinct email to register, but got %d", status)
+		}
+		if status := register(app, "A.B+X@Gmail.com"); status != fiber.StatusConflict {
+			t.Errorf("Expected a case-only difference to conflict, but got %d", status)
+		}
+	})
+}
+
+func TestCreatedIDsAreDistinct(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+
+	bookIDs := make(map[float64]bool)
+	for i := 0; i < 1000; i++ {
+		status, body := doRequest(t, app, "POST", "/admin/book", adminToken, fiber.Map{
+			"title": fmt.Sprintf("Book %d", i),
+		})
+		if status != fiber.StatusOK {
+			t.Fatalf("Expected status 200, but got %d: %v", status, body)
+		}
+		bookIDs[body["id"].(float64)] = true
+	}
+	if len(bookIDs) != 1000 {
+		t.Errorf("Expected 1000 distinct book IDs, but got %d", len(bookIDs))
+	}
+
+	userIDs := make(map[uint]bool)
+	for i := 0; i < 1000; i++ {
+		user := database.User{Email: fmt.Sprintf("reader%d@example.com", i), Role: database.UserRoleStandard}
+		if err := database.GetDB().Create(&user).Error; err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+		if user.UserID != user.ID {
+			t.Fatalf("Expected UserID %d to match the assigned ID, but got %d", user.ID, user.UserID)
+		}
+		userIDs[user.UserID] = true
+	}
+	if len(userIDs) != 1000 {
+		t.Errorf("Expected 1000 distinct user IDs, but got %d", len(userIDs))
+	}
+}
+
+func TestCreateBookHandler_DuplicateID(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	existing := createTestBook(t, database.Book{Title: "Dune"})
+
+	// A client-supplied ID is ignored rather than colliding with an existing book
+	status, body := doRequest(t, app, "POST", "/admin/book", adminToken, fiber.Map{
+		"id":    existing.ID,
+		"title": "Dune Messiah",
+	})
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+	if body["id"].(float64) == float64(existing.ID) {
+		t.Errorf("Expected a new ID to be assigned, but got the existing one")
+	}
+}
+
+func TestAddToCartHandler_PreOrderAtZeroStock(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	release := time.Now().AddDate(0, 1, 0)
+	book := createTestBook(t, database.Book{
+		Title:       "Coming Soon",
+		Price:       25,
+		Quantity:    0,
+		PreOrder:    true,
+		ReleaseDate: &release,
+	})
+
+	status, body := doRequest(t, app, "POST", "/user/cart", token, fiber.Map{
+		"book_id":  book.ID,
+		"quantity": 2,
+	})
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected a pre-order to be carted at zero stock, but got %d: %v", status, body)
+	}
+
+	_, body = doRequest(t, app, "GET", fmt.Sprintf("/user/book/%d", book.ID), token, nil)
+	if body["pre_order_badge"] != true {
+		t.Errorf("Expected a pre-order badge before release, but got %v", body["pre_order_badge"])
+	}
+}
+
+func TestUserNotes_AdminOnly(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	user, userToken := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+
+	notesPath := fmt.Sprintf("/admin/user/%d/notes", user.ID)
+	for _, text := range []string{"Called about a late delivery", "Refund approved"} {
+		status, body := doRequest(t, app, "POST", notesPath, adminToken, fiber.Map{"text": text})
+		if status != fiber.StatusOK {
+			t.Fatalf("Expected status 200, but got %d: %v", status, body)
+		}
+	}
+
+	status, body := doRequest(t, app, "GET", notesPath, adminToken, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+	notes := body["notes"].([]interface{})
+	if len(notes) != 2 {
+		t.Fatalf("Expected 2 notes, but got %d", len(notes))
+	}
+	if text := notes[0].(map[string]interface{})["text"]; text != "Refund approved" {
+		t.Errorf("Expected the newest note first, but got %v", text)
+	}
+
+	// The user can't read notes, and their profile doesn't include them
+	if status, _ := doRequest(t, app, "GET", notesPath, userToken, nil); status != fiber.StatusForbidden {
+		t.Errorf("Expected a non-admin to be refused, but got %d", status)
+	}
+	_, profile := doRequest(t, app, "GET", fmt.Sprintf("/user/profile/%d", user.ID), userToken, nil)
+	if _, ok := profile["notes"]; ok {
+		t.Error("Expected no notes in the user's own profile")
+	}
+}
+
+func TestGetOutOfStockHandler(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	first, _ := createTestUser(t, "first@example.com", database.UserRoleStandard)
+	second, _ := createTestUser(t, "second@example.com", database.UserRoleStandard)
+
+	createTestBook(t, database.Book{Title: "In Stock", Quantity: 4})
+	quiet := createTestBook(t, database.Book{Title: "Quiet", Quantity: 0})
+	popular := createTestBook(t, database.Book{Title: "Popular", Quantity: 0})
+	createTestBook(t, database.Book{Title: "Oversold", Quantity: -2})
+	postReviews(t, app, popular, 4, 5)
+
+	database.GetDB().Create(&database.CartItem{UserID: first.ID, BookID: popular.ID, Quantity: 1})
+	database.GetDB().Create(&database.CartItem{UserID: second.ID, BookID: popular.ID, Quantity: 1})
+	database.GetDB().Create(&database.CartItem{UserID: first.ID, BookID: quiet.ID, Quantity: 1})
+
+	status, body := doRequest(t, app, "GET", "/admin/books/out-of-stock", adminToken, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+
+	books := body["books"].([]interface{})
+	if len(books) != 3 || body["total"].(float64) != 3 {
+		t.Fatalf("Expected only the 3 books without stock, but got %v", books)
+	}
+
+	top := books[0].(map[string]interface{})
+	if top["title"] != "Popular" || top["demand"].(float64) != 2 {
+		t.Errorf("Expected Popular first with a demand of 2, but got %v", top)
+	}
+	if top["review_count"].(float64) != 2 || top["average_rating"].(float64) != 4.5 {
+		t.Errorf("Expected Popular's live review stats, but got %v and %v", top["review_count"], top["average_rating"])
+	}
+	for _, book := range books {
+		book := book.(map[string]interface{})
+		if book["quantity"].(float64) > 0 {
+			t.Errorf("Expected only books without stock, but got %v", book)
+		}
+		if book["needs_reorder"] != true {
+			t.Errorf("Expected %v to need reordering", book["title"])
+		}
+	}
+}
+
+func TestAddReviewHandler_Cooldown(t *testing.T) {
+	t.Setenv("REVIEW_COOLDOWN", "1m")
+	app := setupTestApp(t)
+
+	_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	first := createTestBook(t, database.Book{Title: "First"})
+	second := createTestBook(t, database.Book{Title: "Second"})
+
+	status, body := doRequest(t, app, "POST", fmt.Sprintf("/user/book/%d/reviews", first.ID), token, fiber.Map{
+		"rating":  4,
+		"comment": "Great",
+	})
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected the first review to succeed, but got %d: %v", status, body)
+	}
+
+	status, _ = doRequest(t, app, "POST", fmt.Sprintf("/user/book/%d/reviews", second.ID), token, fiber.Map{
+		"rating":  5,
+		"comment": "Also great",
+	})
+	if status != fiber.StatusTooManyRequests {
+		t.Errorf("Expected status 429 for the second review, but got %d", status)
+	}
+
+	// Deleting the review doesn't reset the cooldown
+	if status, deleted := doRequest(t, app, "DELETE", fmt.Sprintf("/user/reviews/%v", body["ID"]), token, nil); status != fiber.StatusOK {
+		t.Fatalf("Expected the review to be deleted, but got %d: %v", status, deleted)
+	}
+	status, _ = doRequest(t, app, "POST", fmt.Sprintf("/user/book/%d/reviews", first.ID), token, fiber.Map{
+		"rating":  5,
+		"comment": "Great after all",
+	})
+	if status != fiber.StatusTooManyRequests {
+		t.Errorf("Expected status 429 for a review posted again after deleting one, but got %d", status)
+	}
+}
+
+func TestGetAllBooksHandler_DatabaseErrorIsSanitized(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+
+	var logs bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	// Force the query to fail
+	if err := database.GetDB().Migrator().DropTable(&database.Book{}); err != nil {
+		t.Fatalf("Failed to drop table: %v", err)
+	}
+
+	status, body := doRequest(t, app, "GET", "/user/books", token, nil)
+	if status != fiber.StatusInternalServerError {
+		t.Fatalf("Expected status 500, but got %d", status)
+	}
+	if body["message"] != "Failed to fetch books" {
+		t.Errorf("Expected a clean error message, but got %v", body["message"])
+	}
+
+	if !strings.Contains(logs.String(), "no such table") {
+		t.Errorf("Expected the database error to be logged, but got %q", logs.String())
+	}
+	if !strings.Contains(logs.String(), "level=ERROR") || !strings.Contains(logs.String(), "stack=") {
+		t.Errorf("Expected an error-level log with a stack trace, but got %q", logs.String())
+	}
+}
+
+func TestAddReviewHandler_Duplicate(t *testing.T) {
+	t.Setenv("REVIEW_COOLDOWN", "0")
+	app := setupTestApp(t)
+
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	book := createTestBook(t, database.Book{Title: "Once Only"})
+
+	// Both rows can't exist at once
+	db := database.GetDB()
+	db.Create(&database.Review{UserID: user.ID, BookID: book.ID, Rating: 3})
+	if err := db.Create(&database.Review{UserID: user.ID, BookID: book.ID, Rating: 4}).Error; err == nil {
+		t.Fatal("Expected the unique index to reject a second review of the same book")
+	}
+	db.Unscoped().Where("user_id = ?", user.ID).Delete(&database.Review{})
+
+	const requests = 2
+	statuses := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			payload, _ := json.Marshal(fiber.Map{"rating": 5, "comment": "Clicked twice"})
+			req := httptest.NewRequest("POST", fmt.Sprintf("/user/book/%d/reviews", book.ID), bytes.NewReader(payload))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	counts := map[int]int{}
+	for i := 0; i < requests; i++ {
+		counts[<-statuses]++
+	}
+	if counts[fiber.StatusOK] != 1 || counts[fiber.StatusConflict] != 1 {
+		t.Errorf("Expected one review to be added and one to conflict, but got %v", counts)
+	}
+
+	var count int64
+	db.Model(&database.Review{}).Where("user_id = ? AND book_id = ?", user.ID, book.ID).Count(&count)
+	if count != 1 {
+		t.Fatalf("Expected a single review, but got %d", count)
+	}
+
+	// Deleted reviews don't block reviewing the book again
+	db.Where("user_id = ?", user.ID).Delete(&database.Review{})
+	if status, body := doRequest(t, app, "POST", fmt.Sprintf("/user/book/%d/reviews", book.ID), token, fiber.Map{"rating": 4}); status != fiber.StatusOK {
+		t.Errorf("Expected the book to be reviewed again, but got %d: %v", status, body)
+	}
+}
+
+func TestAddReviewHandler_SoftDeletedBook(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	earlier, _ := createTestUser(t, "earlier@example.com", database.UserRoleStandard)
+	_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	book := createTestBook(t, database.Book{Title: "Retired"})
+
+	database.GetDB().Create(&database.Review{BookID: book.ID, UserID: earlier.ID, Rating: 4, Comment: "Before it was removed"})
+
+	if status, _ := doRequest(t, app, "DELETE", fmt.Sprintf("/admin/book/%d", book.ID), adminToken, nil); status != fiber.StatusOK {
+		t.Fatalf("Expected the book to be deleted, but got %d", status)
+	}
+
+	status, body := doRequest(t, app, "POST", fmt.Sprintf("/user/book/%d/reviews", book.ID), token, fiber.Map{
+		"rating":  5,
+		"comment": "Too late",
+	})
+	if status != fiber.StatusConflict {
+		t.Errorf("Expected status 409, but got %d: %v", status, body)
+	}
+
+	var count int64
+	database.GetDB().Model(&database.Review{}).Where("book_id = ?", book.ID).Count(&count)
+	if count != 1 {
+		t.Errorf("Expected only the earlier review to remain, but got %d", count)
+	}
+}
+
+func TestGetUserActivityHandler_Interleaved(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	user, _ := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	book := createTestBook(t, database.Book{Title: "Timeline"})
+	second := createTestBook(t, database.Book{Title: "Timeline II"})
+
+	base := time.Now().Add(-time.Hour)
+	db := database.GetDB()
+	db.Create(&database.CartItem{Model: gorm.Model{CreatedAt: base.Add(1 * time.Minute)}, UserID: user.ID, BookID: book.ID, Quantity: 1})
+	db.Create(&database.Review{Model: gorm.Model{CreatedAt: base.Add(2 * time.Minute)}, UserID: user.ID, BookID: book.ID, Rating: 4})
+	db.Create(&database.CartItem{Model: gorm.Model{CreatedAt: base.Add(3 * time.Minute)}, UserID: user.ID, BookID: second.ID, Quantity: 2})
+	db.Create(&database.Review{Model: gorm.Model{CreatedAt: base.Add(4 * time.Minute)}, UserID: user.ID, BookID: second.ID, Rating: 5})
+
+	status, body := doRequest(t, app, "GET", fmt.Sprintf("/admin/user/%d/activity?limit=4", user.ID), adminToken, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+
+	// The signup happened just now, so it is the newest event
+	events := body["events"].([]interface{})
+	want := []string{"signup", "review", "cart_add", "review"}
+	if len(events) != len(want) {
+		t.Fatalf("Expected %d events, but got %d", len(want), len(events))
+	}
+	for i, event := range events {
+		if got := event.(map[string]interface{})["type"]; got != want[i] {
+			t.Errorf("Expected event %d to be %q, but got %q", i, want[i], got)
+		}
+	}
+	if body["total"].(float64) != 5 {
+		t.Errorf("Expected 5 events in total, but got %v", body["total"])
+	}
+}
+
+func TestAddReviewHandler_SanitizesComment(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"", "Don't miss it, 5 > 4 < 6 alert(1) read"},
+		{"markdown", "Don't miss it, 5 > 4  6 alert(1) read"},
+	}
+
+	for _, tt := range tests {
+		t.Run("format="+tt.format, func(t *testing.T) {
+			t.Setenv("REVIEW_COMMENT_FORMAT", tt.format)
+			app := setupTestApp(t)
+
+			_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+			book := createTestBook(t, database.Book{Title: "Safe"})
+
+			status, body := doRequest(t, app, "POST", fmt.Sprintf("/user/book/%d/reviews", book.ID), token, fiber.Map{
+				"rating":  5,
+				"comment": "Don't miss it, 5 > 4 < 6 <scr<b>ipt>alert(1)</script> read",
+			})
+			if status != fiber.StatusOK {
+				t.Fatalf("Expected status 200, but got %d: %v", status, body)
+			}
+
+			var stored database.Review
+			database.GetDB().Where("book_id = ?", book.ID).First(&stored)
+			if stored.Comment != tt.want {
+				t.Errorf("Expected stored comment %q, but got %q", tt.want, stored.Comment)
+			}
+
+			// The listing's data is an array, which doRequest doesn't decode
+			req := httptest.NewRequest("GET", fmt.Sprintf("/user/book/%d/reviews", book.ID), nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			var envelope struct{ Data []database.Review }
+			if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+				t.Fatalf("Failed to decode reviews: %v", err)
+			}
+			listed := envelope.Data
+			if len(listed) != 1 || listed[0].Comment != tt.want {
+				t.Errorf("Expected listed comment %q, but got %v", tt.want, listed)
+			}
+		})
+	}
+}
+
+func TestGetUnreviewedBooksHandler(t *testing.T) {
+	app := setupTestApp(t)
+
+	admin, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	reviewed := createTestBook(t, database.Book{Title: "Reviewed"})
+	unreviewed := createTestBook(t, database.Book{Title: "Unreviewed", AverageRating: 4.2})
+
+	database.GetDB().Create(&database.Review{BookID: reviewed.ID, UserID: admin.ID, Rating: 3})
+
+	status, body := doRequest(t, app, "GET", "/admin/books/unreviewed", adminToken, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+
+	books := body["books"].([]interface{})
+	if len(books) != 1 || body["total"].(float64) != 1 {
+		t.Fatalf("Expected exactly one unreviewed book, but got %v", body)
+	}
+	if got := books[0].(map[string]interface{})["title"]; got != unreviewed.Title {
+		t.Errorf("Expected %q, but got %q", unreviewed.Title, got)
+	}
+	if got := books[0].(map[string]interface{})["average_rating"]; got != float64(0) {
+		t.Errorf("Expected the stale stored rating to be replaced by 0, but got %v", got)
+	}
+}
+
+func TestRegisterHandler_CommonPasswordBlocklist(t *testing.T) {
+	path := t.TempDir() + "/common-passwords.txt"
+	if err := os.WriteFile(path, []byte("# top passwords\n123456\npassword123\nqwerty\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write blocklist: %v", err)
+	}
+	t.Setenv("COMMON_PASSWORDS_FILE", path)
+	app := setupTestApp(t)
+
+	register := func(email, password string) (int, map[string]interface{}) {
+		return doRequest(t, app, "POST", "/register", "", fiber.Map{
+			"firstname": "Test",
+			"lastname":  "User",
+			"email":     email,
+			"password":  password,
+			"role":      database.UserRoleStandard,
+		})
+	}
+
+	status, body := register("common@example.com", "Password123")
+	if status != fiber.StatusBadRequest {
+		t.Errorf("Expected status 400 for a common password, but got %d: %v", status, body)
+	}
+
+	status, body = register("unique@example.com", "correct horse battery staple")
+	if status != fiber.StatusOK {
+		t.Errorf("Expected status 200 for an uncommon password, but got %d: %v", status, body)
+	}
+}
+
+func TestGetAllBooksHandler_PaginationAndSort(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	for i, price := range []float64{30, 10, 50, 20, 40} {
+		createTestBook(t, database.Book{Title: fmt.Sprintf("Book %d", i), Price: price})
+	}
+
+	status, body := doRequest(t, app, "GET", "/user/books?sort=price&order=desc&page=2&limit=2", token, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+	if body["total"].(float64) != 5 || body["page"].(float64) != 2 || body["limit"].(float64) != 2 {
+		t.Errorf("Unexpected pagination fields: %v", body)
+	}
+
+	books := body["books"].([]interface{})
+	want := []float64{30, 20}
+	if len(books) != len(want) {
+		t.Fatalf("Expected %d books, but got %d", len(want), len(books))
+	}
+	for i, book := range books {
+		if got := book.(map[string]interface{})["price"]; got != want[i] {
+			t.Errorf("Expected book %d to cost %v, but got %v", i, want[i], got)
+		}
+	}
+
+	// The limit is capped
+	_, body = doRequest(t, app, "GET", "/user/books?limit=100000", token, nil)
+	if body["limit"].(float64) != 100 {
+		t.Errorf("Expected the limit to be capped at 100, but got %v", body["limit"])
+	}
+
+	for _, query := range []string{"sort=colour", "sort=price&order=sideways"} {
+		if status, _ := doRequest(t, app, "GET", "/user/books?"+query, token, nil); status != fiber.StatusBadRequest {
+			t.Errorf("Expected status 400 for %q, but got %d", query, status)
+		}
+	}
+}
+
+func TestSearchBooksHandler(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	createTestBook(t, database.Book{Title: "The Fellowship of the Ring", Author: "J.R.R. Tolkien", Genre: "Fantasy", Price: 15})
+	hobbit := createTestBook(t, database.Book{Title: "The Hobbit", Author: "J.R.R. Tolkien", Genre: "Fantasy", Price: 9})
+	createTestBook(t, database.Book{Title: "Ring of Fire", Author: "Someone Else", Genre: "Thriller", Price: 12})
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"q=tolkien+ring", 1},
+		{"q=TOLKIEN", 2},
+		{"q=ring", 2},
+		{"q=ring&genre=thriller", 1},
+		{"q=tolkien&max_price=10", 1},
+		{"q=tolkien&min_price=10&max_price=20", 1},
+		{"q=", 3},
+	}
+
+	for _, tt := range tests {
+		status, body := doRequest(t, app, "GET", "/user/books/search?"+tt.query, token, nil)
+		if status != fiber.StatusOK {
+			t.Errorf("%s: expected status 200, but got %d: %v", tt.query, status, body)
+			continue
+		}
+		if got := body["total"].(float64); int(got) != tt.want || len(body["books"].([]interface{})) != tt.want {
+			t.Errorf("%s: expected %d books, but got %v", tt.query, tt.want, body)
+		}
+	}
+
+	// Results carry live review stats
+	postReviews(t, app, hobbit, 2, 4)
+	_, body := doRequest(t, app, "GET", "/user/books/search?q=hobbit", token, nil)
+	if found := body["books"].([]interface{})[0].(map[string]interface{}); found["review_count"].(float64) != 2 || found["average_rating"].(float64) != 3 {
+		t.Errorf("Expected 2 reviews averaging 3, but got %v and %v", found["review_count"], found["average_rating"])
+	}
+
+	if status, _ := doRequest(t, app, "GET", "/user/books/search?min_price=cheap", token, nil); status != fiber.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid price, but got %d", status)
+	}
+}
+
+func TestBulkUnfeatureOutOfStockHandler(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	soldOut := createTestBook(t, database.Book{Title: "Sold Out", Featured: true, Quantity: 0})
+	inStock := createTestBook(t, database.Book{Title: "In Stock", Featured: true, Quantity: 4})
+
+	status, body := doRequest(t, app, "POST", "/admin/books/unfeature-out-of-stock", adminToken, nil)
+	if status != fiber.StatusOK || body["updated"].(float64) != 1 {
+		t.Fatalf("Expected one book to be unfeatured, but got %d: %v", status, body)
+	}
+
+	var unfeatured, featured database.Book
+	database.GetDB().First(&unfeatured, soldOut.ID)
+	if unfeatured.Featured {
+		t.Error("Expected the sold out book to be unfeatured")
+	}
+	database.GetDB().First(&featured, inStock.ID)
+	if !featured.Featured {
+		t.Error("Expected the in-stock book to stay featured")
+	}
+}
+
+func TestUpdateBookHandler_AutoUnfeaturesAtZeroStock(t *testing.T) {
+	t.Setenv("AUTO_UNFEATURE_OUT_OF_STOCK", "true")
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	book := createTestBook(t, database.Book{Title: "Popular", Featured: true, Quantity: 1})
+
+	update := func(quantity int) database.Book {
+		status, body := doRequest(t, app, "PUT", fmt.Sprintf("/admin/book/%d", book.ID), adminToken, fiber.Map{
+			"title":    book.Title,
+			"quantity": quantity,
+		})
+		if status != fiber.StatusOK {
+			t.Fatalf("Expected status 200, but got %d: %v", status, body)
+		}
+		var stored database.Book
+		database.GetDB().First(&stored, book.ID)
+		return stored
+	}
+
+	if stored := update(0); stored.Featured {
+		t.Error("Expected the book to be unfeatured when it ran out of stock")
+	}
+	if stored := update(10); stored.Featured {
+		t.Error("Expected restocking not to feature the book again")
+	}
+}
+
+func TestAddToCartHandler_MaxPerUser(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	limit := uint(3)
+	book := createTestBook(t, database.Book{Title: "Limited Edition", Price: 50, Quantity: 100, MaxPerUser: &limit})
+
+	add := func(quantity uint) (int, map[string]interface{}) {
+		return doRequest(t, app, "POST", "/user/cart", token, fiber.Map{"book_id": book.ID, "quantity": quantity})
+	}
+
+	if status, body := add(2); status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+	if status, body := add(1); status != fiber.StatusOK {
+		t.Fatalf("Expected buying up to the limit to succeed, but got %d: %v", status, body)
+	}
+
+	status, body := add(1)
+	if status != fiber.StatusBadRequest {
+		t.Fatalf("Expected status 400 past the limit, but got %d: %v", status, body)
+	}
+	if body["remaining"].(float64) != 0 {
+		t.Errorf("Expected 0 remaining, but got %v", body["remaining"])
+	}
+
+	var item database.CartItem
+	database.GetDB().Where("book_id = ?", book.ID).First(&item)
+	if item.Quantity != limit {
+		t.Errorf("Expected the cart to hold %d copies, but got %d", limit, item.Quantity)
+	}
+
+	if status, _ := doRequest(t, app, "PUT", fmt.Sprintf("/user/cart/%d", book.ID), token, fiber.Map{"quantity": 4}); status != fiber.StatusBadRequest {
+		t.Errorf("Expected status 400 when updating past the limit, but got %d", status)
+	}
+}
+
+func TestGetCartItemPriceHandler_TierDiscount(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	book := createTestBook(t, database.Book{
+		Title:    "Bulk Buy",
+		Price:    12.5,
+		Quantity: 100,
+		PriceTiers: []database.PriceTier{
+			{MinQuantity: 5, DiscountPercent: 10},
+			{MinQuantity: 10, DiscountPercent: 20},
+		},
+	})
+
+	status, cart := doRequest(t, app, "POST", "/user/cart", token, fiber.Map{"book_id": book.ID, "quantity": 6})
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, cart)
+	}
+
+	status, body := doRequest(t, app, "GET", fmt.Sprintf("/user/cart/%d/price", book.ID), token, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+
+	price := body["price"].(map[string]interface{})
+	want := map[string]float64{
+		"unit_price":            12.5,
+		"quantity":              6,
+		"base_price":            75,
+		"tier_discount_percent": 10,
+		"tier_discount":         7.5,
+		"subtotal":              67.5,
+	}
+	for field, value := range want {
+		if price[field] != value {
+			t.Errorf("Expected %s to be %v, but got %v", field, value, price[field])
+		}
+	}
+
+	// The breakdown matches what the cart charges
+	if price["subtotal"] != cart["subtotal"] {
+		t.Errorf("Expected subtotal %v to match the cart's %v", price["subtotal"], cart["subtotal"])
+	}
+}
+
+func TestAddToCartHandler_EnforcesStock(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	book := createTestBook(t, database.Book{Title: "Scarce", Price: 10, Quantity: 3})
+	release := time.Now().Add(24 * time.Hour)
+	preOrder := createTestBook(t, database.Book{Title: "Coming Soon", Price: 10, PreOrder: true, ReleaseDate: &release})
+
+	if status, body := doRequest(t, app, "POST", "/user/cart", token, fiber.Map{"book_id": book.ID, "quantity": 2}); status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+
+	// The amount already in the cart counts towards the stock
+	status, body := doRequest(t, app, "POST", "/user/cart", token, fiber.Map{"book_id": book.ID, "quantity": 2})
+	if status != fiber.StatusBadRequest || body["message"] != "Only 3 copies available" {
+		t.Errorf("Expected a 400 stock error, but got %d: %v", status, body)
+	}
+
+	if status, _ := doRequest(t, app, "PUT", fmt.Sprintf("/user/cart/%d", book.ID), token, fiber.Map{"quantity": 50}); status != fiber.StatusBadRequest {
+		t.Errorf("Expected status 400 when updating past the stock, but got %d", status)
+	}
+
+	if status, body := doRequest(t, app, "POST", "/user/cart", token, fiber.Map{"book_id": preOrder.ID, "quantity": 5}); status != fiber.StatusOK {
+		t.Errorf("Expected unreleased pre-orders to be cartable without stock, but got %d: %v", status, body)
+	}
+}
+
+func TestPlaceOrderHandler(t *testing.T) {
+	app := setupTestApp(t)
+
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	first := createTestBook(t, database.Book{Title: "First", Price: 10, Quantity: 5})
+	second := createTestBook(t, database.Book{Title: "Second", Price: 4, Quantity: 2})
+	db := database.GetDB()
+
+	db.Create(&database.CartItem{UserID: user.ID, BookID: first.ID, Quantity: 3, Subtotal: 30})
+	db.Create(&database.CartItem{UserID: user.ID, BookID: second.ID, Quantity: 2, Subtotal: 8})
+
+	// Another buyer takes a copy of the second book, so the whole checkout must roll back
+	db.Model(&second).UpdateColumn("quantity", 1)
+
+	status, body := doRequest(t, app, "POST", "/user/orders", token, nil)
+	if status != fiber.StatusBadRequest {
+		t.Fatalf("Expected status 400, but got %d: %v", status, body)
+	}
+
+	var stock database.Book
+	db.First(&stock, first.ID)
+	if stock.Quantity != 5 {
+		t.Errorf("Expected the first book's stock to be untouched, but got %d", stock.Quantity)
+	}
+	var count int64
+	db.Model(&database.CartItem{}).Where("user_id = ?", user.ID).Count(&count)
+	if count != 2 {
+		t.Errorf("Expected the cart to be kept, but it has %d items", count)
+	}
+
+	db.Model(&second).UpdateColumn("quantity", 2)
+	status, body = doRequest(t, app, "POST", "/user/orders", token, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+	if body["total"].(float64) != 38 {
+		t.Errorf("Expected a total of 38, but got %v", body["total"])
+	}
+
+	var afterFirst, afterSecond database.Book
+	db.First(&afterFirst, first.ID)
+	db.First(&afterSecond, second.ID)
+	if afterFirst.Quantity != 2 || afterSecond.Quantity != 0 {
+		t.Errorf("Expected stock of 2 and 0, but got %d and %d", afterFirst.Quantity, afterSecond.Quantity)
+	}
+	db.Model(&database.CartItem{}).Where("user_id = ?", user.ID).Count(&count)
+	if count != 0 {
+		t.Errorf("Expected the cart to be cleared, but it has %d items", count)
+	}
+
+	if status, _ := doRequest(t, app, "POST", "/user/orders", token, nil); status != fiber.StatusBadRequest {
+		t.Errorf("Expected status 400 for an empty cart, but got %d", status)
+	}
+}
+
+func TestPlaceOrderHandler_PreOrder(t *testing.T) {
+	app := setupTestApp(t)
+
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	release := time.Now().Add(24 * time.Hour)
+	preOrder := createTestBook(t, database.Book{Title: "Coming Soon", Price: 10, Quantity: 1, PreOrder: true, ReleaseDate: &release})
+	inStock := createTestBook(t, database.Book{Title: "On The Shelf", Price: 5, Quantity: 4})
+	db := database.GetDB()
+
+	for _, item := range []fiber.Map{{"book_id": preOrder.ID, "quantity": 3}, {"book_id": inStock.ID, "quantity": 1}} {
+		if status, body := doRequest(t, app, "POST", "/user/cart", token, item); status != fiber.StatusOK {
+			t.Fatalf("Expected status 200, but got %d: %v", status, body)
+		}
+	}
+
+	status, body := doRequest(t, app, "POST", "/user/orders", token, nil)
+	if status != fiber.StatusOK || body["status"] != string(database.OrderStatusPreOrdered) {
+		t.Fatalf("Expected a pre-ordered order, but got %d: %v", status, body)
+	}
+
+	var stock database.Book
+	db.First(&stock, preOrder.ID)
+	if stock.Quantity != 1 {
+		t.Errorf("Expected pre-ordered stock to be untouched until release, but got %d", stock.Quantity)
+	}
+
+	// Nothing is released before the release date
+	if released, err := releasePreOrders(db, time.Now()); err != nil || released != 0 {
+		t.Fatalf("Expected nothing to be released yet, but got %d: %v", released, err)
+	}
+
+	released, err := releasePreOrders(db, release.Add(time.Minute))
+	if err != nil || released != 1 {
+		t.Fatalf("Expected one item to be released, but got %d: %v", released, err)
+	}
+	db.First(&stock, preOrder.ID)
+	if stock.Quantity != -2 {
+		t.Errorf("Expected the pre-ordered copies to be taken at release, but got %d", stock.Quantity)
+	}
+
+	var order database.Order
+	db.Preload("Items").Where("user_id = ?", user.ID).First(&order)
+	if order.Status != database.OrderStatusCompleted {
+		t.Errorf("Expected the order to be completed at release, but got %s", order.Status)
+	}
+	for _, item := range order.Items {
+		if item.Status != database.OrderStatusCompleted {
+			t.Errorf("Expected every item to be completed, but got %+v", item)
+		}
+	}
+
+	// Releasing again takes nothing more
+	if released, _ := releasePreOrders(db, release.Add(time.Hour)); released != 0 {
+		t.Errorf("Expected a second release to do nothing, but got %d", released)
+	}
+}
+
+func TestPlaceOrderHandler_LastCopy(t *testing.T) {
+	app := setupTestApp(t)
+
+	book := createTestBook(t, database.Book{Title: "Last Copy", Price: 10, Quantity: 1})
+	var tokens []string
+	for i := 0; i < 2; i++ {
+		user, token := createTestUser(t, fmt.Sprintf("buyer%d@example.com", i), database.UserRoleStandard)
+		database.GetDB().Create(&database.CartItem{UserID: user.ID, BookID: book.ID, Quantity: 1, Subtotal: 10})
+		tokens = append(tokens, token)
+	}
+
+	statuses := make(chan int, len(tokens))
+	for _, token := range tokens {
+		go func(token string) {
+			req := httptest.NewRequest("POST", "/user/orders", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}(token)
+	}
+
+	succeeded := 0
+	for range tokens {
+		if <-statuses == fiber.StatusOK {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("Expected exactly one order to succeed, but %d did", succeeded)
+	}
+
+	var stored database.Book
+	database.GetDB().First(&stored, book.ID)
+	if stored.Quantity != 0 {
+		t.Errorf("Expected the stock to be 0, but got %d", stored.Quantity)
+	}
+}
+
+func TestOrderHistory(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	other, _ := createTestUser(t, "other@example.com", database.UserRoleStandard)
+	book := createTestBook(t, database.Book{Title: "Priced", Price: 10, Quantity: 10})
+	db := database.GetDB()
+
+	// The stored subtotal is stale, so the order must be priced server-side
+	db.Create(&database.CartItem{UserID: user.ID, BookID: book.ID, Quantity: 2, Subtotal: 1})
+	status, placed := doRequest(t, app, "POST", "/user/orders", token, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, placed)
+	}
+	if placed["total"].(float64) != 20 || placed["status"] != string(database.OrderStatusCompleted) {
+		t.Errorf("Unexpected order: %v", placed)
+	}
+
+	// A later price change doesn't affect the order
+	db.Model(&book).UpdateColumn("price", 99)
+	db.Create(&database.Order{UserID: other.ID, Total: 5, Status: database.OrderStatusCompleted})
+
+	status, body := doRequest(t, app, "GET", "/user/orders", token, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+	orders := body["orders"].([]interface{})
+	if len(orders) != 1 || body["total"].(float64) != 1 {
+		t.Fatalf("Expected only the user's own order, but got %v", body)
+	}
+	items := orders[0].(map[string]interface{})["items"].([]interface{})
+	item := items[0].(map[string]interface{})
+	if len(items) != 1 || item["unit_price"].(float64) != 10 || item["quantity"].(float64) != 2 || item["title"] != book.Title {
+		t.Errorf("Expected the line item priced at purchase time, but got %v", items)
+	}
+
+	_, body = doRequest(t, app, "GET", "/admin/orders", adminToken, nil)
+	if body["total"].(float64) != 2 {
+		t.Errorf("Expected admins to see all 2 orders, but got %v", body["total"])
+	}
+	_, body = doRequest(t, app, "GET", fmt.Sprintf("/admin/orders?user_id=%d", other.ID), adminToken, nil)
+	if body["total"].(float64) != 1 {
+		t.Errorf("Expected 1 order for the other user, but got %v", body["total"])
+	}
+}
+
+func TestAddToCartHandler_MaxPerUserCountsOrders(t *testing.T) {
+	app := setupTestApp(t)
+
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	limit := uint(3)
+	book := createTestBook(t, database.Book{Title: "Limited Edition", Price: 50, Quantity: 100, MaxPerUser: &limit})
+
+	database.GetDB().Create(&database.Order{
+		UserID: user.ID,
+		Status: database.OrderStatusCompleted,
+		Items:  []database.OrderItem{{BookID: book.ID, Quantity: 2, UnitPrice: 50, Subtotal: 100}},
+	})
+
+	if status, body := doRequest(t, app, "POST", "/user/cart", token, fiber.Map{"book_id": book.ID, "quantity": 1}); status != fiber.StatusOK {
+		t.Fatalf("Expected the last allowed copy to be added, but got %d: %v", status, body)
+	}
+
+	status, body := doRequest(t, app, "POST", "/user/cart", token, fiber.Map{"book_id": book.ID, "quantity": 1})
+	if status != fiber.StatusBadRequest || body["remaining"].(float64) != 0 {
+		t.Errorf("Expected a 400 with nothing remaining, but got %d: %v", status, body)
+	}
+}
+
+func TestPlaceOrderHandler_MaxPerUser(t *testing.T) {
+	app := setupTestApp(t)
+
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	limit := uint(3)
+	book := createTestBook(t, database.Book{Title: "Limited Edition", Price: 50, Quantity: 100, MaxPerUser: &limit})
+	db := database.GetDB()
+
+	if status, body := doRequest(t, app, "POST", "/user/cart", token, fiber.Map{"book_id": book.ID, "quantity": 3}); status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+
+	// The limit is lowered after the book was carted, and checkout through the older route
+	// still enforces it
+	db.Model(&book).UpdateColumn("max_per_user", 2)
+	status, body := doRequest(t, app, "POST", "/user/checkout", token, nil)
+	if status != fiber.StatusBadRequest || body["remaining"].(float64) != 2 || body["book_id"].(float64) != float64(book.ID) {
+		t.Fatalf("Expected a 400 with 2 remaining, but got %d: %v", status, body)
+	}
+
+	var stock database.Book
+	db.First(&stock, book.ID)
+	if stock.Quantity != 100 {
+		t.Errorf("Expected the stock to be untouched, but got %d", stock.Quantity)
+	}
+
+	// Copies bought in another order since count too
+	db.Model(&book).UpdateColumn("max_per_user", 4)
+	db.Create(&database.Order{
+		OrderNumber: "BK-ELSEWHERE",
+		UserID:      user.ID,
+		Status:      database.OrderStatusCompleted,
+		Items:       []database.OrderItem{{BookID: book.ID, Quantity: 2, UnitPrice: 50, Subtotal: 100}},
+	})
+	if status, body := doRequest(t, app, "POST", "/user/orders", token, nil); status != fiber.StatusBadRequest || body["remaining"].(float64) != 2 {
+		t.Errorf("Expected a 400 with 2 remaining, but got %d: %v", status, body)
+	}
+
+	db.Model(&book).UpdateColumn("max_per_user", 5)
+	if status, body := doRequest(t, app, "POST", "/user/orders", token, nil); status != fiber.StatusOK {
+		t.Errorf("Expected the order up to the limit to be placed, but got %d: %v", status, body)
+	}
+}
+
+func TestBatchStockHandler(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	inStock := createTestBook(t, database.Book{Title: "In Stock", Quantity: 7})
+	soldOut := createTestBook(t, database.Book{Title: "Sold Out", Quantity: 0})
+
+	status, body := doRequest(t, app, "POST", "/user/books/stock", token, fiber.Map{
+		"ids": []uint{inStock.ID, soldOut.ID, 9999},
+	})
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+
+	stock := body["stock"].(map[string]interface{})
+	if len(stock) != 2 {
+		t.Fatalf("Expected unknown IDs to be left out, but got %v", stock)
+	}
+	available := stock[fmt.Sprint(inStock.ID)].(map[string]interface{})
+	if available["quantity"].(float64) != 7 || available["in_stock"] != true {
+		t.Errorf("Unexpected stock for the in-stock book: %v", available)
+	}
+	unavailable := stock[fmt.Sprint(soldOut.ID)].(map[string]interface{})
+	if unavailable["quantity"].(float64) != 0 || unavailable["in_stock"] != false {
+		t.Errorf("Unexpected stock for the sold out book: %v", unavailable)
+	}
+
+	tooMany := make([]uint, 101)
+	for i := range tooMany {
+		tooMany[i] = uint(i + 1)
+	}
+	if status, _ := doRequest(t, app, "POST", "/user/books/stock", token, fiber.Map{"ids": tooMany}); status != fiber.StatusBadRequest {
+		t.Errorf("Expected status 400 for too many ids, but got %d", status)
+	}
+}
+
+func TestGetAllBooksHandler_ReviewStats(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	unrated := createTestBook(t, database.Book{Title: "Unrated"})
+	good := createTestBook(t, database.Book{Title: "Good"})
+	great := createTestBook(t, database.Book{Title: "Great"})
+
+	db := database.GetDB()
+	// Each user reviews a book at most once
+	for i, review := range []database.Review{
+		{BookID: good.ID, Rating: 3}, {BookID: good.ID, Rating: 3}, {BookID: good.ID, Rating: 4},
+		{BookID: great.ID, Rating: 4}, {BookID: great.ID, Rating: 5},
+	} {
+		reviewer, _ := createTestUser(t, fmt.Sprintf("reviewer%d@example.com", i), database.UserRoleStandard)
+		review.UserID = reviewer.ID
+		db.Create(&review)
+	}
+
+	status, body := doRequest(t, app, "GET", "/user/books?sort=average_rating&order=desc", token, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+
+	want := []struct {
+		title  string
+		rating float64
+		count  float64
+	}{
+		{great.Title, 4.5, 2},
+		{good.Title, 3.3, 3},
+		{unrated.Title, 0, 0},
+	}
+	books := body["books"].([]interface{})
+	if len(books) != len(want) {
+		t.Fatalf("Expected %d books, but got %d", len(want), len(books))
+	}
+	for i, w := range want {
+		book := books[i].(map[string]interface{})
+		if book["title"] != w.title || book["average_rating"] != w.rating || book["review_count"] != w.count {
+			t.Errorf("Expected book %d to be %s with %v over %v reviews, but got %v", i, w.title, w.rating, w.count, book)
+		}
+	}
+
+	status, body = doRequest(t, app, "GET", fmt.Sprintf("/user/book/%d", good.ID), token, nil)
+	if status != fiber.StatusOK || body["average_rating"] != 3.3 || body["review_count"] != float64(3) {
+		t.Errorf("Expected the single book to report 3.3 over 3 reviews, but got %d: %v", status, body)
+	}
+}
+
+func TestPlaceOrderHandler_OrderNumbers(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	_, otherToken := createTestUser(t, "other@example.com", database.UserRoleStandard)
+	book := createTestBook(t, database.Book{Title: "Numbered", Price: 10, Quantity: 10})
+
+	var numbers []string
+	for i := 0; i < 2; i++ {
+		database.GetDB().Create(&database.CartItem{UserID: user.ID, BookID: book.ID, Quantity: 1})
+		status, body := doRequest(t, app, "POST", "/user/orders", token, nil)
+		if status != fiber.StatusOK {
+			t.Fatalf("Expected status 200, but got %d: %v", status, body)
+		}
+		number, _ := body["order_number"].(string)
+		if !strings.HasPrefix(number, "BK-") || len(number) != len("BK-")+10 {
+			t.Errorf("Unexpected order number %q", number)
+		}
+		numbers = append(numbers, number)
+	}
+	if numbers[0] == numbers[1] {
+		t.Fatalf("Expected distinct order numbers, but both were %q", numbers[0])
+	}
+
+	for _, number := range numbers {
+		status, body := doRequest(t, app, "GET", "/user/orders/"+number, token, nil)
+		if status != fiber.StatusOK || body["order_number"] != number {
+			t.Errorf("Expected to fetch order %s, but got %d: %v", number, status, body)
+		}
+		if status, _ := doRequest(t, app, "GET", "/admin/orders/"+number, adminToken, nil); status != fiber.StatusOK {
+			t.Errorf("Expected admins to fetch order %s, but got %d", number, status)
+		}
+
+		// Other users can't see the order
+		if status, _ := doRequest(t, app, "GET", "/user/orders/"+number, otherToken, nil); status != fiber.StatusNotFound {
+			t.Errorf("Expected status 404 for another user's order, but got %d", status)
+		}
+	}
+
+	// Lookups by ID still work
+	var order database.Order
+	database.GetDB().Where("order_number = ?", numbers[0]).First(&order)
+	if status, body := doRequest(t, app, "GET", fmt.Sprintf("/user/orders/%d", order.ID), token, nil); status != fiber.StatusOK || body["order_number"] != numbers[0] {
+		t.Errorf("Expected to fetch the order by ID, but got %d: %v", status, body)
+	}
+}
+
+func TestAddReviewHandler_Validation(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   fiber.Map
+		status int
+	}{
+		{"rating 0", fiber.Map{"rating": 0, "comment": "Nothing"}, fiber.StatusBadRequest},
+		{"rating 6", fiber.Map{"rating": 6, "comment": "Too much"}, fiber.StatusBadRequest},
+		{"negative rating", fiber.Map{"rating": -1}, fiber.StatusBadRequest},
+		{"fractional rating", fiber.Map{"rating": 3.5}, fiber.StatusBadRequest},
+		{"long comment", fiber.Map{"rating": 3, "comment": strings.Repeat("a", 2001)}, fiber.StatusBadRequest},
+		{"rating 3", fiber.Map{"rating": 3, "comment": "Decent"}, fiber.StatusOK},
+		{"rating 3 without comment", fiber.Map{"rating": 3}, fiber.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := setupTestApp(t)
+
+			_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+			book := createTestBook(t, database.Book{Title: "Rated"})
+
+			status, body := doRequest(t, app, "POST", fmt.Sprintf("/user/book/%d/reviews", book.ID), token, tt.body)
+			if status != tt.status {
+				t.Errorf("Expected status %d, but got %d: %v", tt.status, status, body)
+			}
+
+			var count int64
+			database.GetDB().Model(&database.Review{}).Count(&count)
+			if stored := count == 1; stored != (tt.status == fiber.StatusOK) {
+				t.Errorf("Expected a review to be stored only for valid payloads, but found %d", count)
+			}
+		})
+	}
+}
+
+func TestGetUserReviewsHandler(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	user, _ := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	other, _ := createTestUser(t, "other@example.com", database.UserRoleStandard)
+	older := createTestBook(t, database.Book{Title: "Older Read"})
+	newer := createTestBook(t, database.Book{Title: "Newer Read"})
+
+	db := database.GetDB()
+	db.Create(&database.Review{Model: gorm.Model{CreatedAt: time.Now().Add(-time.Hour)}, BookID: older.ID, UserID: user.ID, Rating: 2})
+	db.Create(&database.Review{BookID: newer.ID, UserID: user.ID, Rating: 5})
+	db.Create(&database.Review{BookID: newer.ID, UserID: other.ID, Rating: 1})
+
+	status, body := doRequest(t, app, "GET", fmt.Sprintf("/admin/users/%d/reviews", user.ID), adminToken, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+
+	reviews := body["reviews"].([]interface{})
+	if len(reviews) != 2 || body["total"].(float64) != 2 {
+		t.Fatalf("Expected the user's 2 reviews, but got %v", body)
+	}
+	for i, title := range []string{newer.Title, older.Title} {
+		if got := reviews[i].(map[string]interface{})["book_title"]; got != title {
+			t.Errorf("Expected review %d to be for %q, but got %q", i, title, got)
+		}
+	}
+
+	if status, _ := doRequest(t, app, "GET", "/admin/users/9999/reviews", adminToken, nil); status != fiber.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown user, but got %d", status)
+	}
+}
+
+func TestUpdateAndDeleteReviewHandlers(t *testing.T) {
+	t.Setenv("REVIEW_COOLDOWN", "0")
+	app := setupTestApp(t)
+
+	owner, ownerToken := createTestUser(t, "owner@example.com", database.UserRoleStandard)
+	_, otherToken := createTestUser(t, "other@example.com", database.UserRoleStandard)
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	book := createTestBook(t, database.Book{Title: "Revisited"})
+
+	review := database.Review{
+		Model:   gorm.Model{CreatedAt: time.Now().Add(-time.Hour), UpdatedAt: time.Now().Add(-time.Hour)},
+		BookID:  book.ID,
+		UserID:  owner.ID,
+		Rating:  2,
+		Comment: "Meh",
+	}
+	database.GetDB().Create(&review)
+	path := fmt.Sprintf("/user/reviews/%d", review.ID)
+	update := fiber.Map{"rating": 4, "comment": "Better on a second read, it's great"}
+
+	// Nobody else can touch the review, admins included
+	for _, token := range []string{otherToken, adminToken} {
+		if status, _ := doRequest(t, app, "PUT", path, token, update); status != fiber.StatusForbidden {
+			t.Errorf("Expected status 403 when updating another user's review, but got %d", status)
+		}
+		if status, _ := doRequest(t, app, "DELETE", path, token, nil); status != fiber.StatusForbidden {
+			t.Errorf("Expected status 403 when deleting another user's review, but got %d", status)
+		}
+	}
+
+	if status, body := doRequest(t, app, "PUT", path, ownerToken, fiber.Map{"rating": 9}); status != fiber.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid rating, but got %d: %v", status, body)
+	}
+
+	status, body := doRequest(t, app, "PUT", path, ownerToken, update)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+	var stored database.Review
+	database.GetDB().First(&stored, review.ID)
+	if stored.Rating != 4 || stored.Comment != "Better on a second read, it's great" {
+		t.Errorf("Expected the review to be updated, but got %+v", stored)
+	}
+	if !stored.UpdatedAt.After(review.UpdatedAt) {
+		t.Errorf("Expected updated_at to be refreshed, but it is still %v", stored.UpdatedAt)
+	}
+
+	if status, body := doRequest(t, app, "DELETE", path, ownerToken, nil); status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+	if status, _ := doRequest(t, app, "PUT", path, ownerToken, update); status != fiber.StatusNotFound {
+		t.Errorf("Expected status 404 for a deleted review, but got %d", status)
+	}
+	if _, body := doRequest(t, app, "GET", fmt.Sprintf("/user/book/%d/reviews", book.ID), ownerToken, nil); body["message"] != "No reviews for this book" {
+		t.Errorf("Expected the deleted review to be left out of the book's reviews, but got %v", body)
+	}
+
+	// With the old review gone the user can post a fresh one
+	status, body = doRequest(t, app, "POST", fmt.Sprintf("/user/book/%d/reviews", book.ID), ownerToken, fiber.Map{"rating": 5})
+	if status != fiber.StatusOK {
+		t.Errorf("Expected a new review to be accepted, but got %d: %v", status, body)
+	}
+}
+
+func TestDownloadBookHandler(t *testing.T) {
+	app := setupTestApp(t)
+
+	buyer, buyerToken := createTestUser(t, "buyer@example.com", database.UserRoleStandard)
+	_, browserToken := createTestUser(t, "browser@example.com", database.UserRoleStandard)
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+
+	path := t.TempDir() + "/secret-location.pdf"
+	if err := os.WriteFile(path, []byte("%PDF-1.4 book contents"), 0o644); err != nil {
+		t.Fatalf("Failed to write book file: %v", err)
+	}
+	book := createTestBook(t, database.Book{Title: "The Go Book", Path: path})
+	missing := createTestBook(t, database.Book{Title: "Missing File", Path: t.TempDir() + "/gone.pdf"})
+
+	for _, purchased := range []database.Book{book, missing} {
+		database.GetDB().Create(&database.Order{
+			OrderNumber: fmt.Sprintf("TEST-%d", purchased.ID),
+			UserID:      buyer.ID,
+			Status:      database.OrderStatusCompleted,
+			Items:       []database.OrderItem{{BookID: purchased.ID, Quantity: 1}},
+		})
+	}
+
+	download := func(token string, id uint) *http.Response {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/user/book/%d/download", id), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := download(buyerToken, book.ID)
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", resp.StatusCode)
+	}
+	content, _ := io.ReadAll(resp.Body)
+	if string(content) != "%PDF-1.4 book contents" {
+		t.Errorf("Unexpected file contents %q", content)
+	}
+	if got := resp.Header.Get(fiber.HeaderContentType); got != "application/pdf" {
+		t.Errorf("Expected Content-Type application/pdf, but got %q", got)
+	}
+	if got := resp.Header.Get(fiber.HeaderContentDisposition); got != `attachment; filename="The_Go_Book.pdf"` {
+		t.Errorf("Unexpected Content-Disposition %q", got)
+	}
+
+	if resp := download(browserToken, book.ID); resp.StatusCode != fiber.StatusForbidden {
+		t.Errorf("Expected status 403 for a user who hasn't bought the book, but got %d", resp.StatusCode)
+	}
+	if resp := download(adminToken, book.ID); resp.StatusCode != fiber.StatusOK {
+		t.Errorf("Expected admins to download any book, but got %d", resp.StatusCode)
+	}
+	if resp := download(buyerToken, missing.ID); resp.StatusCode != fiber.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing file, but got %d", resp.StatusCode)
+	}
+
+	// A pre-order can't be downloaded until the book is released
+	release := time.Now().Add(30 * 24 * time.Hour)
+	unreleased := createTestBook(t, database.Book{Title: "Coming Soon", Path: path, PreOrder: true, ReleaseDate: &release})
+	database.GetDB().Create(&database.Order{
+		OrderNumber: "TEST-PRE",
+		UserID:      buyer.ID,
+		Status:      database.OrderStatusPreOrdered,
+		Items:       []database.OrderItem{{BookID: unreleased.ID, Quantity: 1, Status: database.OrderStatusPreOrdered}},
+	})
+	if resp := download(buyerToken, unreleased.ID); resp.StatusCode != fiber.StatusForbidden {
+		t.Errorf("Expected status 403 for an unreleased pre-order, but got %d", resp.StatusCode)
+	}
+
+	// The server path never appears in book responses
+	_, body := doRequest(t, app, "GET", fmt.Sprintf("/user/book/%d", book.ID), buyerToken, nil)
+	if _, ok := body["path"]; ok {
+		t.Errorf("Expected the book path to be hidden, but got %v", body)
+	}
+}
+
+func TestAddToCartHandler_ConcurrentFirstAdds(t *testing.T) {
+	app := setupTestApp(t)
+
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	book := createTestBook(t, database.Book{Title: "In Demand", Price: 10, Quantity: 100})
+
+	// Both rows can't exist at once
+	db := database.GetDB()
+	db.Create(&database.CartItem{UserID: user.ID, BookID: book.ID, Quantity: 1})
+	if err := db.Create(&database.CartItem{UserID: user.ID, BookID: book.ID, Quantity: 1}).Error; err == nil {
+		t.Fatal("Expected the unique index to reject a second cart row for the same book")
+	}
+	db.Unscoped().Where("user_id = ?", user.ID).Delete(&database.CartItem{})
+
+	// The test database queues these requests on one connection, so the race between their
+	// inserts is covered by TestAddToCart_RetriesDuplicateInsert
+	const requests = 2
+	statuses := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			payload, _ := json.Marshal(fiber.Map{"book_id": book.ID, "quantity": 2})
+			req := httptest.NewRequest("POST", "/user/cart", bytes.NewReader(payload))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	for i := 0; i < requests; i++ {
+		if status := <-statuses; status != fiber.StatusOK {
+			t.Errorf("Expected status 200, but got %d", status)
+		}
+	}
+
+	var items []database.CartItem
+	db.Where("user_id = ? AND book_id = ?", user.ID, book.ID).Find(&items)
+	if len(items) != 1 {
+		t.Fatalf("Expected a single cart row, but got %d", len(items))
+	}
+	if items[0].Quantity != 2*requests || items[0].Subtotal != float64(20*requests) {
+		t.Errorf("Expected the quantities to be summed, but got %+v", items[0])
+	}
+
+	// Removed items are soft-deleted and don't block adding the book again
+	doRequest(t, app, "DELETE", fmt.Sprintf("/user/cart/%d", book.ID), token, nil)
+	if status, body := doRequest(t, app, "POST", "/user/cart", token, fiber.Map{"book_id": book.ID, "quantity": 1}); status != fiber.StatusOK {
+		t.Errorf("Expected the book to be added again, but got %d: %v", status, body)
+	}
+}
+
+func TestAddToCart_RetriesDuplicateInsert(t *testing.T) {
+	for _, path := range []string{"/user/cart", "/user/cart/bulk"} {
+		t.Run(path, func(t *testing.T) {
+			app := setupTestApp(t)
+
+			user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+			book := createTestBook(t, database.Book{Title: "In Demand", Price: 10, Quantity: 100})
+
+			// Another request commits its first add of the book on its own connection, between
+			// this one's cart lookup and its insert
+			other, err := gorm.Open(sqlite.Open(testDSN(t)), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+			if err != nil {
+				t.Fatalf("Failed to open a second connection: %v", err)
+			}
+			t.Cleanup(func() {
+				if sqlDB, err := other.DB(); err == nil {
+					sqlDB.Close()
+				}
+			})
+
+			db := database.GetDB()
+			raced := false
+			db.Callback().Create().Before("gorm:create").Register("race_cart_add", func(tx *gorm.DB) {
+				if _, ok := tx.Statement.Dest.(*database.CartItem); ok && !raced {
+					raced = true
+					if err := other.Create(&database.CartItem{UserID: user.ID, BookID: book.ID, Quantity: 1, Subtotal: 10}).Error; err != nil {
+						t.Errorf("Failed to add the competing cart item: %v", err)
+					}
+				}
+			})
+
+			var payload interface{} = fiber.Map{"book_id": book.ID, "quantity": 2}
+			if path == "/user/cart/bulk" {
+				payload = fiber.Map{"items": []interface{}{payload}}
+			}
+			status, body := doRequest(t, app, "POST", path, token, payload)
+			if status != fiber.StatusOK || (path == "/user/cart/bulk" && body["added"] != float64(1)) {
+				t.Fatalf("Expected the add to be retried and succeed, but got %d: %v", status, body)
+			}
+			if !raced {
+				t.Fatal("Expected the competing insert to run")
+			}
+
+			var items []database.CartItem
+			db.Where("user_id = ?", user.ID).Find(&items)
+			if len(items) != 1 || items[0].Quantity != 3 || items[0].Subtotal != 30 {
+				t.Errorf("Expected the retry to merge into a single cart row for 3 copies, but got %+v", items)
+			}
+		})
+	}
+}
+
+func TestGetBookDeleteImpactHandler(t *testing.T) {
+	app := setupTestApp(t)
+
+	admin, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	user, _ := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	book := createTestBook(t, database.Book{Title: "Referenced"})
+	other := createTestBook(t, database.Book{Title: "Elsewhere"})
+
+	db := database.GetDB()
+	db.Create(&database.CartItem{UserID: user.ID, BookID: book.ID, Quantity: 1})
+	db.Create(&database.CartItem{UserID: admin.ID, BookID: other.ID, Quantity: 1})
+	db.Create(&database.Review{UserID: user.ID, BookID: book.ID, Rating: 4})
+	db.Create(&database.Order{
+		OrderNumber: "TEST-1",
+		UserID:      user.ID,
+		Status:      database.OrderStatusCompleted,
+		Items:       []database.OrderItem{{BookID: book.ID, Quantity: 1}, {BookID: book.ID, Quantity: 2}},
+	})
+
+	status, body := doRequest(t, app, "GET", fmt.Sprintf("/admin/book/%d/delete-impact", book.ID), adminToken, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+	want := map[string]float64{"carts": 1, "reviews": 1, "orders": 1}
+	for field, count := range want {
+		if body[field] != count {
+			t.Errorf("Expected %v %s, but got %v", count, field, body[field])
+		}
+	}
+
+	if status, _ := doRequest(t, app, "GET", "/admin/book/9999/delete-impact", adminToken, nil); status != fiber.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown book, but got %d", status)
+	}
+}
+
+func TestAdminRoutes_RequireAdminRole(t *testing.T) {
+	app := setupTestApp(t)
+
+	customer, customerToken := createTestUser(t, "customer@example.com", database.UserRoleStandard)
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	victim, _ := createTestUser(t, "victim@example.com", database.UserRoleStandard)
+
+	blocked := []struct{ method, path string }{
+		{"DELETE", fmt.Sprintf("/admin/user/%d", victim.ID)},
+		{"GET", "/admin/users"},
+		{"POST", "/admin/book"},
+		{"GET", "/admin/cart"},
+	}
+	for _, route := range blocked {
+		if status, body := doRequest(t, app, route.method, route.path, customerToken, fiber.Map{}); status != fiber.StatusForbidden {
+			t.Errorf("%s %s: expected status 403 for a customer, but got %d: %v", route.method, route.path, status, body)
+		}
+	}
+
+	var count int64
+	database.GetDB().Model(&database.User{}).Where("id = ?", victim.ID).Count(&count)
+	if count != 1 {
+		t.Fatal("Expected the customer's delete to be refused")
+	}
+
+	if status, body := doRequest(t, app, "DELETE", fmt.Sprintf("/admin/user/%d", victim.ID), adminToken, nil); status != fiber.StatusOK {
+		t.Errorf("Expected an admin to delete the user, but got %d: %v", status, body)
+	}
+
+	// Customers keep access to their own routes
+	if status, _ := doRequest(t, app, "GET", fmt.Sprintf("/user/profile/%d", customer.ID), customerToken, nil); status != fiber.StatusOK {
+		t.Errorf("Expected the customer to reach their profile, but got %d", status)
+	}
+}
+
+func TestRefreshTokenFlow(t *testing.T) {
+	app := setupTestApp(t)
+
+	user, _ := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	profilePath := fmt.Sprintf("/user/profile/%d", user.ID)
+
+	status, login := doRequest(t, app, "POST", "/login", "", fiber.Map{"email": user.Email, "password": testPassword})
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, login)
+	}
+	refreshToken, _ := login["refresh_token"].(string)
+	if refreshToken == "" {
+		t.Fatalf("Expected a refresh token, but got %v", login)
+	}
+
+	// Only the hash is stored
+	var hashed, raw int64
+	database.GetDB().Model(&database.RefreshToken{}).Where("token_hash = ?", hashRefreshToken(refreshToken)).Count(&hashed)
+	database.GetDB().Model(&database.RefreshToken{}).Where("token_hash = ?", refreshToken).Count(&raw)
+	if hashed != 1 || raw != 0 {
+		t.Errorf("Expected the refresh token to be stored hashed, but found %d hashed and %d raw", hashed, raw)
+	}
+
+	longAgo := time.Now().AddDate(-1, 0, 0)
+	database.GetDB().Model(&user).UpdateColumn("last_login_at", longAgo)
+
+	status, refreshed := doRequest(t, app, "POST", "/refresh", "", fiber.Map{"refresh_token": refreshToken})
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, refreshed)
+	}
+
+	// Refreshing counts as activity for the inactivity job
+	var stored database.User
+	database.GetDB().First(&stored, user.ID)
+	if stored.LastLoginAt == nil || !stored.LastLoginAt.After(longAgo) {
+		t.Errorf("Expected the refresh to update last_login_at, but got %v", stored.LastLoginAt)
+	}
+	accessToken := refreshed["token"].(string)
+	if status, _ := doRequest(t, app, "GET", profilePath, accessToken, nil); status != fiber.StatusOK {
+		t.Errorf("Expected the new access token to work, but got %d", status)
+	}
+
+	// Refresh tokens are rotated, so the old one is spent
+	if status, body := doRequest(t, app, "POST", "/refresh", "", fiber.Map{"refresh_token": refreshToken}); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a used refresh token, but got %d: %v", status, body)
+	}
+	if status, _ := doRequest(t, app, "GET", profilePath, login["token"].(string), nil); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected the old session's access token to stop working, but got %d", status)
+	}
+
+	// Logging out ends the access token and the refresh token at once
+	if status, body := doRequest(t, app, "POST", "/user/logout", accessToken, nil); status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+	if status, _ := doRequest(t, app, "GET", profilePath, accessToken, nil); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected a logged out access token to be rejected, but got %d", status)
+	}
+	if status, _ := doRequest(t, app, "POST", "/refresh", "", fiber.Map{"refresh_token": refreshed["refresh_token"]}); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected a logged out refresh token to be rejected, but got %d", status)
+	}
+
+	if status, _ := doRequest(t, app, "POST", "/refresh", "", fiber.Map{"refresh_token": "not-a-token"}); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected status 401 for an unknown refresh token, but got %d", status)
+	}
+}
+
+func TestRefreshTokenHandler_Expired(t *testing.T) {
+	app := setupTestApp(t)
+
+	user, _ := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	_, refreshToken, err := createSession(database.GetDB(), user.ID)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	database.GetDB().Model(&database.RefreshToken{}).
+		Where("token_hash = ?", hashRefreshToken(refreshToken)).
+		UpdateColumn("expires_at", time.Now().Add(-time.Minute))
+
+	status, body := doRequest(t, app, "POST", "/refresh", "", fiber.Map{"refresh_token": refreshToken})
+	if status != fiber.StatusUnauthorized || body["message"] != "Refresh token has expired" {
+		t.Errorf("Expected a 401 for an expired refresh token, but got %d: %v", status, body)
+	}
+}
+
+func TestCheckJWTValidity_SessionExpiry(t *testing.T) {
+	app := setupTestApp(t)
+
+	user, _ := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	profilePath := fmt.Sprintf("/user/profile/%d", user.ID)
+	_, refreshToken, err := createSession(database.GetDB(), user.ID)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	var session database.RefreshToken
+	database.GetDB().Where("token_hash = ?", hashRefreshToken(refreshToken)).First(&session)
+
+	// A token about to expire is reissued, but only until its session ends
+	sessionEnds := time.Now().Add(2 * time.Minute)
+	database.GetDB().Model(&session).UpdateColumn("expires_at", sessionEnds)
+	token, err := CreateToken(user.ID, session.ID, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", profilePath, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", resp.StatusCode)
+	}
+
+	refreshed, _, err := new(jwt.Parser).ParseUnverified(resp.Header.Get("X-Refreshed-Token"), jwt.MapClaims{})
+	if err != nil {
+		t.Fatalf("Expected a refreshed token, but got %v", err)
+	}
+	if exp := int64(refreshed.Claims.(jwt.MapClaims)["exp"].(float64)); exp > sessionEnds.Unix() {
+		t.Errorf("Expected the refreshed token to expire by %d, but it expires at %d", sessionEnds.Unix(), exp)
+	}
+
+	// Once the session is over its access tokens stop working, even if they haven't expired
+	database.GetDB().Model(&session).UpdateColumn("expires_at", time.Now().Add(-time.Second))
+	status, body := doRequest(t, app, "GET", profilePath, token, nil)
+	if status != fiber.StatusUnauthorized || body["message"] != "Session has ended, please log in again" {
+		t.Errorf("Expected a 401 for an expired session, but got %d: %v", status, body)
+	}
+}
+
+func TestAccountHandlers_RevokeSessions(t *testing.T) {
+	tests := []struct {
+		name, method, path string
+	}{
+		{"deactivate", "PUT", "/user/deactivate/%d"},
+		{"delete", "DELETE", "/user/delete/%d"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := setupTestApp(t)
+
+			user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+			_, refreshToken, err := createSession(database.GetDB(), user.ID)
+			if err != nil {
+				t.Fatalf("Failed to create session: %v", err)
+			}
+
+			if status, body := doRequest(t, app, tt.method, fmt.Sprintf(tt.path, user.ID), token, nil); status != fiber.StatusOK {
+				t.Fatalf("Expected status 200, but got %d: %v", status, body)
+			}
+			if status, _ := doRequest(t, app, "GET", fmt.Sprintf("/user/profile/%d", user.ID), token, nil); status != fiber.StatusUnauthorized {
+				t.Errorf("Expected the access token to be revoked, but got %d", status)
+			}
+			if status, _ := doRequest(t, app, "POST", "/refresh", "", fiber.Map{"refresh_token": refreshToken}); status != fiber.StatusUnauthorized {
+				t.Errorf("Expected the other session's refresh token to be revoked, but got %d", status)
+			}
+		})
+	}
+}
+
+func TestGetCartHandler_RefreshesPrices(t *testing.T) {
+	tests := []struct {
+		mode      string
+		subtotal  float64
+		changed   bool
+		persisted float64
+	}{
+		{"off", 20, false, 20},
+		{"read", 30, true, 20},
+		{"persist", 30, true, 30},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			t.Setenv("CART_PRICE_REFRESH", tt.mode)
+			app := setupTestApp(t)
+
+			_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+			book := createTestBook(t, database.Book{Title: "Dune", Price: 10, Quantity: 10})
+			if status, body := doRequest(t, app, "POST", "/user/cart", token, fiber.Map{
+				"book_id":  book.ID,
+				"quantity": 2,
+			}); status != fiber.StatusOK {
+				t.Fatalf("Expected status 200, but got %d: %v", status, body)
+			}
+			database.GetDB().Model(&book).Update("price", 15)
+
+			// The cart's data is an array, which doRequest doesn't decode
+			req := httptest.NewRequest("GET", "/user/cart", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			var envelope struct{ Data []database.CartItem }
+			if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+				t.Fatalf("Failed to decode cart: %v", err)
+			}
+			items := envelope.Data
+			if len(items) != 1 || items[0].Subtotal != tt.subtotal || items[0].PriceChanged != tt.changed {
+				t.Errorf("Expected subtotal %v with price_changed=%v, but got %+v", tt.subtotal, tt.changed, items)
+			}
+
+			var stored database.CartItem
+			database.GetDB().First(&stored)
+			if stored.Subtotal != tt.persisted {
+				t.Errorf("Expected stored subtotal %v, but got %v", tt.persisted, stored.Subtotal)
+			}
+		})
+	}
+}
+
+func TestUserResponses_OmitPassword(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+
+	for _, tt := range []struct{ path, token string }{
+		{fmt.Sprintf("/user/profile/%d", user.ID), token},
+		{fmt.Sprintf("/admin/user/%d", user.ID), adminToken},
+		{"/admin/users", adminToken},
+	} {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("Expected status 200 from %s, but got %d: %s", tt.path, resp.StatusCode, body)
+		}
+		if strings.Contains(strings.ToLower(string(body)), `"password"`) {
+			t.Errorf("Expected no password in %s, but got %s", tt.path, body)
+		}
+	}
+}
+
+func TestUpdateProfile_ChangesPassword(t *testing.T) {
+	app := setupTestApp(t)
+
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	path := fmt.Sprintf("/user/profile/%d", user.ID)
+
+	// The current password is required to set a new one
+	for _, current := range []string{"", "not-my-password"} {
+		if status, body := doRequest(t, app, "PUT", path, token, fiber.Map{
+			"password":         "a-brand-new-password",
+			"current_password": current,
+		}); status != fiber.StatusForbidden {
+			t.Errorf("Expected status 403 with current password %q, but got %d: %v", current, status, body)
+		}
+	}
+
+	status, body := doRequest(t, app, "PUT", path, token, fiber.Map{
+		"firstname":        "Renamed",
+		"password":         "a-brand-new-password",
+		"current_password": testPassword,
+	})
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+
+	var updated database.User
+	database.GetDB().First(&updated, user.ID)
+	if updated.FirstName != "Renamed" {
+		t.Errorf("Expected the first name to be updated, but got %s", updated.FirstName)
+	}
+	if bcrypt.CompareHashAndPassword(updated.Password, []byte("a-brand-new-password")) != nil {
+		t.Errorf("Expected the new password to be stored")
+	}
+
+	// Changing the password ends the user's sessions
+	if status, _ := doRequest(t, app, "GET", "/user/", token, nil); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected the old token to be rejected, but got %d", status)
+	}
+}
+
+func TestUpdateProfile_OtherUser(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, attackerToken := createTestUser(t, "attacker@example.com", database.UserRoleStandard)
+	victim, _ := createTestUser(t, "victim@example.com", database.UserRoleStandard)
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	path := fmt.Sprintf("/user/profile/%d", victim.ID)
+
+	status, _ := doRequest(t, app, "PUT", path, attackerToken, fiber.Map{
+		"email":            "attacker+victim@example.com",
+		"password":         "a-brand-new-password",
+		"current_password": testPassword,
+	})
+	if status != fiber.StatusForbidden {
+		t.Errorf("Expected status 403 when changing another user's password, but got %d", status)
+	}
+
+	var unchanged database.User
+	database.GetDB().First(&unchanged, victim.ID)
+	if unchanged.Email != "victim@example.com" || bcrypt.CompareHashAndPassword(unchanged.Password, []byte(testPassword)) != nil {
+		t.Errorf("Expected the victim's account to be unchanged, but got %s", unchanged.Email)
+	}
+
+	// Admins can reset another user's password without knowing it
+	if status, body := doRequest(t, app, "PUT", path, adminToken, fiber.Map{"password": "a-brand-new-password"}); status != fiber.StatusOK {
+		t.Errorf("Expected an admin to reset the password, but got %d: %v", status, body)
+	}
+}
+
+func TestAccountHandlers_OtherUser(t *testing.T) {
+	tests := []struct {
+		name, method, path string
+	}{
+		{"deactivate", "PUT", "/user/deactivate/%d"},
+		{"activate", "PUT", "/user/activate/%d"},
+		{"delete", "DELETE", "/user/delete/%d"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := setupTestApp(t)
+
+			_, attackerToken := createTestUser(t, "attacker@example.com", database.UserRoleStandard)
+			victim, victimToken := createTestUser(t, "victim@example.com", database.UserRoleStandard)
+			_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+			path := fmt.Sprintf(tt.path, victim.ID)
+
+			if status, body := doRequest(t, app, tt.method, path, attackerToken, nil); status != fiber.StatusForbidden {
+				t.Errorf("Expected status 403 for another user's account, but got %d: %v", status, body)
+			}
+
+			// The victim's account and sessions are untouched
+			if status, body := doRequest(t, app, "GET", fmt.Sprintf("/user/profile/%d", victim.ID), victimToken, nil); status != fiber.StatusOK || body["active"] != true {
+				t.Errorf("Expected the victim's account to keep working, but got %d: %v", status, body)
+			}
+
+			if status, body := doRequest(t, app, tt.method, path, adminToken, nil); status != fiber.StatusOK {
+				t.Errorf("Expected an admin to manage the account, but got %d: %v", status, body)
+			}
+		})
+	}
+}
+
+func TestUpdateProfile_EmailCollision(t *testing.T) {
+	app := setupTestApp(t)
+
+	createTestUser(t, "taken@example.com", database.UserRoleStandard)
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	path := fmt.Sprintf("/user/profile/%d", user.ID)
+
+	tests := []struct {
+		name   string
+		email  string
+		status int
+	}{
+		{"another user's email", "Taken@Example.com", fiber.StatusConflict},
+		{"invalid format", "not-an-email", fiber.StatusBadRequest},
+		{"own email", "reader@example.com", fiber.StatusOK},
+		{"new email", "fresh@example.com", fiber.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := doRequest(t, app, "PUT", path, token, fiber.Map{"email": tt.email})
+			if status != tt.status {
+				t.Errorf("Expected status %d, but got %d: %v", tt.status, status, body)
+			}
+		})
+	}
+
+	var updated database.User
+	database.GetDB().First(&updated, user.ID)
+	if updated.Email != "fresh@example.com" {
+		t.Errorf("Expected the email to be fresh@example.com, but got %s", updated.Email)
+	}
+}
+
+func TestGetCartTotalHandler(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	repriced := createTestBook(t, database.Book{Title: "Dune", Price: 10, Quantity: 10})
+	deleted := createTestBook(t, database.Book{Title: "Emma", Price: 5, Quantity: 10})
+	soldOut := createTestBook(t, database.Book{Title: "Ulysses", Price: 8, Quantity: 10})
+
+	for _, book := range []database.Book{repriced, deleted, soldOut} {
+		if status, body := doRequest(t, app, "POST", "/user/cart", token, fiber.Map{
+			"book_id":  book.ID,
+			"quantity": 2,
+		}); status != fiber.StatusOK {
+			t.Fatalf("Expected status 200, but got %d: %v", status, body)
+		}
+	}
+	database.GetDB().Model(&repriced).Update("price", 12)
+	database.GetDB().Delete(&deleted)
+	database.GetDB().Model(&soldOut).Update("quantity", 0)
+
+	status, body := doRequest(t, app, "GET", "/user/cart/total", token, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+	if body["total"].(float64) != 40 || body["item_count"].(float64) != 4 {
+		t.Errorf("Expected a total of 40 for 4 items, but got %v for %v", body["total"], body["item_count"])
+	}
+
+	items := body["items"].([]interface{})
+	if len(items) != 3 {
+		t.Fatalf("Expected 3 items, but got %d", len(items))
+	}
+	want := []struct {
+		stale, deleted, outOfStock bool
+	}{
+		{true, false, false},
+		{false, true, false},
+		{false, false, true},
+	}
+	for i, w := range want {
+		item := items[i].(map[string]interface{})
+		if item["stale"] != w.stale || item["book_deleted"] != w.deleted || item["out_of_stock"] != w.outOfStock {
+			t.Errorf("Expected item %d flags %+v, but got %v", i, w, item)
+		}
+	}
+	if price := items[0].(map[string]interface{})["price"].(map[string]interface{}); price["subtotal"].(float64) != 24 {
+		t.Errorf("Expected the repriced line to cost 24, but got %v", price["subtotal"])
+	}
+}
+
+func TestBulkAddToCartHandler(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	first := createTestBook(t, database.Book{Title: "Dune", Price: 10, Quantity: 5})
+	second := createTestBook(t, database.Book{Title: "Dune Messiah", Price: 12, Quantity: 1})
+
+	status, body := doRequest(t, app, "POST", "/user/cart/bulk", token, fiber.Map{
+		"items": []fiber.Map{
+			{"book_id": first.ID, "quantity": 2},
+			{"book_id": second.ID, "quantity": 3},
+			{"book_id": 999, "quantity": 1},
+			{"book_id": first.ID, "quantity": 1},
+		},
+	})
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+	if body["added"].(float64) != 2 || body["failed"].(float64) != 2 {
+		t.Errorf("Expected 2 added and 2 failed, but got %v and %v", body["added"], body["failed"])
+	}
+
+	results := body["results"].([]interface{})
+	wantErrors := []string{"", "Only 1 copies available", "Book not found", ""}
+	for i, want := range wantErrors {
+		result := results[i].(map[string]interface{})
+		if result["success"] != (want == "") || (want != "" && result["error"] != want) {
+			t.Errorf("Expected result %d to fail with %q, but got %v", i, want, result)
+		}
+	}
+
+	var items []database.CartItem
+	database.GetDB().Find(&items)
+	if len(items) != 1 || items[0].BookID != first.ID || items[0].Quantity != 3 || items[0].Subtotal != 30 {
+		t.Errorf("Expected 3 copies of the first book for 30, but got %+v", items)
+	}
+}
+
+func TestClearCartHandler(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	other, _ := createTestUser(t, "other@example.com", database.UserRoleStandard)
+	for _, title := range []string{"Dune", "Emma"} {
+		book := createTestBook(t, database.Book{Title: title, Price: 10, Quantity: 5})
+		if status, body := doRequest(t, app, "POST", "/user/cart", token, fiber.Map{
+			"book_id":  book.ID,
+			"quantity": 1,
+		}); status != fiber.StatusOK {
+			t.Fatalf("Expected status 200, but got %d: %v", status, body)
+		}
+		database.GetDB().Create(&database.CartItem{UserID: other.ID, BookID: book.ID, Quantity: 1})
+	}
+
+	status, body := doRequest(t, app, "DELETE", "/user/cart", token, nil)
+	if status != fiber.StatusOK || body["removed"].(float64) != 2 {
+		t.Fatalf("Expected 2 items removed, but got %d: %v", status, body)
+	}
+
+	var remaining int64
+	database.GetDB().Model(&database.CartItem{}).Count(&remaining)
+	if remaining != 2 {
+		t.Errorf("Expected the other user's 2 items to remain, but got %d", remaining)
+	}
+}
+
+func TestUploadBookFilesHandler_BothFilesAtLimit(t *testing.T) {
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	t.Setenv("UPLOAD_MAX_MB", "3")
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	book := createTestBook(t, database.Book{Title: "The Go Book"})
+
+	// Together the files are over Fiber's default 4MB body limit
+	var payload bytes.Buffer
+	form := multipart.NewWriter(&payload)
+	for field, header := range map[string]string{"cover": "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "file": "%PDF-1.4 "} {
+		part, err := form.CreateFormFile(field, field+".bin")
+		if err != nil {
+			t.Fatalf("Failed to create form file: %v", err)
+		}
+		part.Write(append([]byte(header), make([]byte, 3<<20-len(header))...))
+	}
+	form.Close()
+
+	req := httptest.NewRequest("POST", fmt.Sprintf("/admin/book/%d/upload", book.ID), &payload)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != fiber.StatusOK {
+		t.Errorf("Expected status 200 for two files at the upload limit, but got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestUploadBookFilesHandler(t *testing.T) {
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	t.Setenv("UPLOAD_MAX_MB", "1")
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	book := createTestBook(t, database.Book{Title: "The Go Book"})
+
+	upload := func(files map[string][]byte) (int, map[string]interface{}) {
+		var payload bytes.Buffer
+		form := multipart.NewWriter(&payload)
+		for field, content := range files {
+			part, err := form.CreateFormFile(field, field+".bin")
+			if err != nil {
+				t.Fatalf("Failed to create form file: %v", err)
+			}
+			part.Write(content)
+		}
+		form.Close()
+
+		req := httptest.NewRequest("POST", fmt.Sprintf("/admin/book/%d/upload", book.ID), &payload)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var envelope struct {
+			Data  map[string]interface{}
+			Error map[string]interface{}
+		}
+		json.NewDecoder(resp.Body).Decode(&envelope)
+		if envelope.Error != nil {
+			return resp.StatusCode, envelope.Error
+		}
+		return resp.StatusCode, envelope.Data
+	}
+
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR cover")
+	pdf := []byte("%PDF-1.4 book contents")
+
+	tests := []struct {
+		name   string
+		files  map[string][]byte
+		status int
+	}{
+		{"nothing uploaded", map[string][]byte{}, fiber.StatusBadRequest},
+		{"cover that isn't an image", map[string][]byte{"cover": pdf}, fiber.StatusBadRequest},
+		{"book file that isn't a PDF or EPUB", map[string][]byte{"file": []byte("plain text")}, fiber.StatusBadRequest},
+		{"oversized book file", map[string][]byte{"file": append(pdf, make([]byte, 1<<20)...)}, fiber.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, body := upload(tt.files); status != tt.status {
+				t.Errorf("Expected status %d, but got %d: %v", tt.status, status, body)
+			}
+		})
+	}
+
+	status, body := upload(map[string][]byte{"cover": png, "file": pdf})
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+	coverURL, _ := body["cover_url"].(string)
+	if !strings.HasPrefix(coverURL, "/covers/") || !strings.HasSuffix(coverURL, ".png") {
+		t.Errorf("Expected a public cover URL, but got %q", coverURL)
+	}
+	if body["file_url"] != fmt.Sprintf("/user/book/%d/download", book.ID) {
+		t.Errorf("Expected the download URL, but got %v", body["file_url"])
+	}
+
+	var stored database.Book
+	database.GetDB().First(&stored, book.ID)
+	content, err := os.ReadFile(stored.Path)
+	if err != nil || string(content) != string(pdf) {
+		t.Errorf("Expected the book file to be stored, but got %q: %v", content, err)
+	}
+
+	resp, err := app.Test(httptest.NewRequest("GET", coverURL, nil), -1)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != fiber.StatusOK {
+		t.Errorf("Expected the cover to be served, but got %d", resp.StatusCode)
+	}
+
+	// A new cover replaces the old one on disk
+	if status, body := upload(map[string][]byte{"cover": png}); status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+	covers, _ := os.ReadDir(filepath.Join(os.Getenv("UPLOAD_DIR"), "covers"))
+	if len(covers) != 1 {
+		t.Errorf("Expected only the new cover to remain, but got %d files", len(covers))
+	}
+
+	// Files stored for a book that can't be saved are removed again
+	database.GetDB().Callback().Update().Before("gorm:update").Register("fail_updates", func(db *gorm.DB) {
+		db.AddError(errors.New("database unavailable"))
+	})
+	if status, _ := upload(map[string][]byte{"file": pdf}); status != fiber.StatusInternalServerError {
+		t.Errorf("Expected status 500, but got %d", status)
+	}
+	files, _ := os.ReadDir(filepath.Join(os.Getenv("UPLOAD_DIR"), "files"))
+	if len(files) != 1 {
+		t.Errorf("Expected only the saved book file to remain, but got %d files", len(files))
+	}
+}
+
+func TestUpdateBookHandler_PartialUpdate(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	limit := uint(2)
+	book := createTestBook(t, database.Book{
+		Title:       "Dune",
+		Description: "Spice and sand",
+		Image:       "/covers/dune.png",
+		Path:        "uploads/files/dune.pdf",
+		Price:       10,
+		Quantity:    5,
+		MaxPerUser:  &limit,
+	})
+	path := fmt.Sprintf("/admin/book/%d", book.ID)
+
+	if status, body := doRequest(t, app, "PUT", path, adminToken, fiber.Map{"price": 0}); status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+
+	var stored database.Book
+	database.GetDB().First(&stored, book.ID)
+	if stored.Price != 0 {
+		t.Errorf("Expected the price to be set to 0, but got %v", stored.Price)
+	}
+	if stored.Title != "Dune" || stored.Description != "Spice and sand" || stored.Image != "/covers/dune.png" ||
+		stored.Path != "uploads/files/dune.pdf" || stored.Quantity != 5 || stored.MaxPerUser == nil {
+		t.Errorf("Expected the other fields to be unchanged, but got %+v", stored)
+	}
+
+	// An explicit null removes the purchase limit
+	if status, body := doRequest(t, app, "PUT", path, adminToken, fiber.Map{"max_per_user": nil}); status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+	var unlimited database.Book
+	database.GetDB().First(&unlimited, book.ID)
+	if unlimited.MaxPerUser != nil || unlimited.Description != "Spice and sand" {
+		t.Errorf("Expected only the purchase limit to be removed, but got %+v", unlimited)
+	}
+}
+
+func TestResponseEnvelope(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	book := createTestBook(t, database.Book{Title: "Dune"})
+
+	send := func(method, path, token string, body interface{}) (int, string) {
+		var reader io.Reader
+		if body != nil {
+			payload, _ := json.Marshal(body)
+			reader = bytes.NewReader(payload)
+		}
+		req := httptest.NewRequest(method, path, reader)
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		raw, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(raw)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   interface{}
+		status int
+		want   string
+	}{
+		{
+			"success", "GET", "/user/name/1", token, nil,
+			fiber.StatusOK, `{"success":true,"data":{"name":"Test"}}`,
+		},
+		{
+			"error", "GET", "/user/book/999", token, nil,
+			fiber.StatusNotFound, `{"success":false,"error":{"message":"Book not found"}}`,
+		},
+		{
+			"validation fields", "POST", "/user/cart/bulk", token, fiber.Map{"items": []fiber.Map{{"book_id": 1}}},
+			fiber.StatusBadRequest, `{"success":false,"error":{"message":"Provide between 1 and 100 items with a book_id and quantity","fields":{"items[0].quantity":"is required"}}}`,
+		},
+		{
+			"named request struct", "POST", fmt.Sprintf("/user/book/%d/reviews", book.ID), token, fiber.Map{"rating": 9},
+			fiber.StatusBadRequest, `{"success":false,"error":{"message":"Invalid input data","fields":{"rating":"must be at most 5"}}}`,
+		},
+		{
+			"invalid token", "GET", "/user/", "not-a-token", nil,
+			fiber.StatusUnauthorized, `{"success":false,"error":{"message":"Invalid or expired JWT"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := send(tt.method, tt.path, tt.token, tt.body)
+			if status != tt.status || body != tt.want {
+				t.Errorf("Expected %d %s, but got %d %s", tt.status, tt.want, status, body)
+			}
+		})
+	}
+}
+
+func TestLoginHandler_LocksAfterRepeatedFailures(t *testing.T) {
+	app := setupTestApp(t)
+
+	user, _ := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	login := func(password string) (int, map[string]interface{}) {
+		return doRequest(t, app, "POST", "/login", "", fiber.Map{"email": user.Email, "password": password})
+	}
+
+	// Failures are only counted while consecutive
+	for i := 0; i < 4; i++ {
+		login("wrong-password")
+	}
+	if status, body := login(testPassword); status != fiber.StatusOK {
+		t.Fatalf("Expected the correct password to log in, but got %d: %v", status, body)
+	}
+
+	for i := 0; i < 4; i++ {
+		if status, body := login("wrong-password"); status != fiber.StatusBadRequest {
+			t.Fatalf("Expected failure %d to be rejected with 400, but got %d: %v", i+1, status, body)
+		}
+	}
+	status, body := login("wrong-password")
+	if status != fiber.StatusTooManyRequests || body["retry_after"].(float64) <= 0 {
+		t.Fatalf("Expected the fifth failure to lock the account, but got %d: %v", status, body)
+	}
+	if status, _ := login(testPassword); status != fiber.StatusTooManyRequests {
+		t.Errorf("Expected the correct password to be refused while locked, but got %d", status)
+	}
+
+	// Once the lockout has passed the user can log in again
+	database.GetDB().Model(&user).UpdateColumn("locked_until", time.Now().Add(-time.Second))
+	if status, body := login(testPassword); status != fiber.StatusOK {
+		t.Errorf("Expected login to work after the lockout, but got %d: %v", status, body)
+	}
+}
+
+func TestLoginHandler_RateLimited(t *testing.T) {
+	t.Setenv("LOGIN_RATE_LIMIT", "3")
+	app := setupTestApp(t)
+
+	for i := 0; i < 3; i++ {
+		status, _ := doRequest(t, app, "POST", "/login", "", fiber.Map{"email": "nobody@example.com", "password": "guess"})
+		if status == fiber.StatusTooManyRequests {
+			t.Fatalf("Expected attempt %d to be allowed", i+1)
+		}
+	}
+
+	payload, _ := json.Marshal(fiber.Map{"email": "someone-else@example.com", "password": "guess"})
+	req := httptest.NewRequest("POST", "/login", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != fiber.StatusTooManyRequests || resp.Header.Get(fiber.HeaderRetryAfter) == "" {
+		t.Errorf("Expected 429 with Retry-After once the IP is over the limit, but got %d", resp.StatusCode)
+	}
+}
+
+func TestGetInventoryReportHandler(t *testing.T) {
+	app := setupTestApp(t)
+
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	reader, readerToken := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	other, _ := createTestUser(t, "other@example.com", database.UserRoleStandard)
+
+	release := time.Now().Add(30 * 24 * time.Hour)
+	low := createTestBook(t, database.Book{Title: "Low", Quantity: 2, PreOrder: true, ReleaseDate: &release})
+	soldOut := createTestBook(t, database.Book{Title: "Sold Out", Quantity: 0})
+	createTestBook(t, database.Book{Title: "Plenty", Quantity: 40})
+	database.GetDB().Create(&database.CartItem{UserID: reader.ID, BookID: low.ID, Quantity: 1})
+	database.GetDB().Create(&database.CartItem{UserID: other.ID, BookID: low.ID, Quantity: 3})
+
+	status, body := doRequest(t, app, "GET", "/admin/books/inventory", adminToken, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %v", status, body)
+	}
+	if body["total_titles"].(float64) != 3 || body["total_units"].(float64) != 42 || body["out_of_stock_titles"].(float64) != 1 {
+		t.Errorf("Unexpected totals %v", body)
+	}
+
+	books := body["books"].([]interface{})
+	if len(books) != 2 {
+		t.Fatalf("Expected 2 low-stock books, but got %d", len(books))
+	}
+	first, second := books[0].(map[string]interface{}), books[1].(map[string]interface{})
+	if first["id"].(float64) != float64(soldOut.ID) || second["id"].(float64) != float64(low.ID) {
+		t.Errorf("Expected the lowest stock first, but got %v then %v", first["title"], second["title"])
+	}
+	if second["in_carts"].(float64) != 2 || second["units_in_carts"].(float64) != 4 {
+		t.Errorf("Expected the low book in 2 carts for 4 copies, but got %v", second)
+	}
+	if first["in_carts"].(float64) != 0 || first["units_in_carts"].(float64) != 0 {
+		t.Errorf("Expected the sold out book in no carts, but got %v", first)
+	}
+	if first["needs_reorder"] != true || second["needs_reorder"] != true {
+		t.Errorf("Expected both low-stock books to need reordering, but got %v and %v", first["needs_reorder"], second["needs_reorder"])
+	}
+	if first["pre_order_badge"] != false || second["pre_order_badge"] != true {
+		t.Errorf("Expected only the unreleased pre-order to have a badge, but got %v and %v", first["pre_order_badge"], second["pre_order_badge"])
+	}
+
+	// A custom threshold narrows the list
+	_, body = doRequest(t, app, "GET", "/admin/books/inventory?threshold=1", adminToken, nil)
+	if books := body["books"].([]interface{}); len(books) != 1 {
+		t.Errorf("Expected 1 book below a threshold of 1, but got %d", len(books))
+	}
+
+	if status, _ := doRequest(t, app, "GET", "/admin/books/inventory", readerToken, nil); status != fiber.StatusForbidden {
+		t.Errorf("Expected non-admins to get 403, but got %d", status)
+	}
+}
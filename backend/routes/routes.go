@@ -3,8 +3,13 @@ package routes
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
 
 	jwtware "github.com/gofiber/jwt/v3"
 	"github.com/mohammadshaad/golang-book-store-backend/middleware"
@@ -21,6 +26,56 @@ func DefineRoutes(app *fiber.App) {
 	defineAdminRoutes(app)
 }
 
+// Read a duration such as "10s" from the environment, falling back to a default
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	duration, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || duration <= 0 {
+		return fallback
+	}
+	return duration
+}
+
+// Read a duration like durationFromEnv, but accept 0 to turn the setting off
+func optionalDurationFromEnv(key string, fallback time.Duration) time.Duration {
+	duration, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || duration < 0 {
+		return fallback
+	}
+	return duration
+}
+
+// Read a non-negative integer from the environment, falling back to a default
+func intFromEnv(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value < 0 {
+		return fallback
+	}
+	return value
+}
+
+// Limit login attempts per key within LOGIN_RATE_WINDOW, e.g. per client IP or per email. Each
+// key is allowed LOGIN_RATE_LIMIT attempts, and the rest are rejected with 429 and Retry-After.
+func loginRateLimit(name string, key func(c *fiber.Ctx) string) fiber.Handler {
+	return limiter.New(limiter.Config{
+		Max:        intFromEnv("LOGIN_RATE_LIMIT", 20),
+		Expiration: durationFromEnv("LOGIN_RATE_WINDOW", time.Minute),
+		KeyGenerator: func(c *fiber.Ctx) string {
+			return name + ":" + key(c)
+		},
+		LimitReached: func(c *fiber.Ctx) error {
+			return middleware.RespondError(c, fiber.StatusTooManyRequests, "Too many login attempts, try again later")
+		},
+	})
+}
+
+// Reject a request whose JWT is missing or invalid, in the same envelope as other errors
+func jwtError(c *fiber.Ctx, err error) error {
+	if err.Error() == "Missing or malformed JWT" {
+		return middleware.RespondError(c, fiber.StatusBadRequest, err.Error())
+	}
+	return middleware.RespondError(c, fiber.StatusUnauthorized, "Invalid or expired JWT")
+}
+
 func StartApp(app *fiber.App, port int) {
 	fmt.Printf("Server is listening on port %d...\n", port)
 	app.Listen(fmt.Sprintf(":%d", port))
@@ -32,19 +87,38 @@ func definePublicRoutes(app *fiber.App) {
 	})
 
 	app.Post("/register", RegisterHandler)
-	app.Post("/login", LoginHandler)
+	app.Post("/login", loginRateLimit("ip", func(c *fiber.Ctx) string {
+		return c.IP()
+	}), loginRateLimit("email", func(c *fiber.Ctx) string {
+		var request struct {
+			Email string `json:"email"`
+		}
+		c.BodyParser(&request)
+		return canonicalizeEmail(request.Email)
+	}), LoginHandler)
+	app.Post("/refresh", RefreshTokenHandler)
+
+	// Uploaded covers are public, book files are only served through the download endpoint
+	app.Static(strings.TrimSuffix(coverURLPrefix, "/"), filepath.Join(uploadDir(), "covers"))
 }
 
 func defineUserRoutes(app *fiber.App) {
 	// Define a middleware to protect routes that require a valid JWT
 	user := app.Group("/user")
 	user.Use(jwtware.New(jwtware.Config{
-		SigningKey: []byte(os.Getenv("JWT_SECRET")),
+		SigningKey:   []byte(os.Getenv("JWT_SECRET")),
+		ErrorHandler: jwtError,
 	}))
 
 	// Modify the middleware to check for JWT validity
 	user.Use(middleware.CheckJWTValidity)
 
+	// Hand out a fresh token when the current one is about to expire
+	user.Use(middleware.RefreshNearExpiry(durationFromEnv("TOKEN_REFRESH_WINDOW", 5*time.Minute), reissueToken))
+
+	// Cancel requests that run longer than the user timeout
+	user.Use(middleware.Timeout(durationFromEnv("USER_REQUEST_TIMEOUT", 10*time.Second)))
+
 	user.Get("/", UserHomePageHandler)
 	user.Get("/profile/:id", Profile)
 	user.Get("/name/:id", GetUserNameHandler)
@@ -55,13 +129,27 @@ func defineUserRoutes(app *fiber.App) {
 	user.Post("/logout", LogoutHandler)
 
 	user.Get("/books", GetAllBooksHandler)
+	user.Get("/books/search", SearchBooksHandler)
+	user.Post("/books/stock", BatchStockHandler)
+	user.Get("/storefront", GetStorefrontHandler)
+	user.Get("/author/:author/books", GetBooksByAuthorHandler)
 	user.Get("/book/:id", GetBookByIDHandler)
 	user.Post("/cart", AddToCartHandler)
+	user.Post("/cart/bulk", BulkAddToCartHandler)
+	user.Delete("/cart", ClearCartHandler)
 	user.Get("/cart", GetCartHandler)
+	user.Get("/cart/total", GetCartTotalHandler)
 	user.Delete("/cart/:book_id", RemoveFromCartHandler)
 	user.Put("/cart/:book_id", UpdateCartItemQuantityHandler)
+	user.Get("/cart/:book_id/price", GetCartItemPriceHandler)
+	user.Post("/orders", PlaceOrderHandler)
+	user.Post("/checkout", PlaceOrderHandler) // Older clients still check out here
+	user.Get("/orders", GetUserOrdersHandler)
+	user.Get("/orders/:ref", GetUserOrderHandler)
 	user.Post("/book/:book_id/reviews", AddReviewHandler)
 	user.Get("/book/:book_id/reviews", GetBookReviewsHandler)
+	user.Put("/reviews/:id", UpdateReviewHandler)
+	user.Delete("/reviews/:id", DeleteReviewHandler)
 	user.Get("/book/:id/download", DownloadBookHandler)
 	// getting the role of the user
 	user.Get("/role/:id", GetUserRoleHandler)
@@ -72,30 +160,63 @@ func defineAdminRoutes(app *fiber.App) {
 	// Define a middleware to protect routes that require a valid JWT
 	admin := app.Group("/admin")
 	admin.Use(jwtware.New(jwtware.Config{
-		SigningKey: []byte(os.Getenv("JWT_SECRET")),
+		SigningKey:   []byte(os.Getenv("JWT_SECRET")),
+		ErrorHandler: jwtError,
 	}))
 
+	// Reject tokens whose session has been revoked
+	admin.Use(middleware.CheckJWTValidity)
+
 	// Add a custom middleware to check for the "admin" role
 	admin.Use(middleware.CheckAdminRole)
 
+	// Hand out a fresh token when the current one is about to expire
+	admin.Use(middleware.RefreshNearExpiry(durationFromEnv("TOKEN_REFRESH_WINDOW", 5*time.Minute), reissueToken))
+
+	// Cancel requests that run longer than the admin timeout
+	admin.Use(middleware.Timeout(durationFromEnv("ADMIN_REQUEST_TIMEOUT", 30*time.Second)))
+
 	// Define a route for the admin section
 	admin.Get("/", func(c *fiber.Ctx) error {
 		return c.SendString("Welcome admin!")
 	})
 
 	admin.Get("/books", GetAllBooksHandler)
+	admin.Get("/books/reorder", GetReorderListHandler)
+	admin.Get("/books/out-of-stock", GetOutOfStockHandler)
+	admin.Get("/books/inventory", GetInventoryReportHandler)
+	admin.Get("/books/unreviewed", GetUnreviewedBooksHandler)
 	admin.Get("/book/:id", GetBookByIDHandler)
 	admin.Post("/book", CreateBookHandler)
 	admin.Put("/book/:id", UpdateBookHandler)
+	admin.Post("/book/:id/upload", UploadBookFilesHandler)
 	admin.Delete("/book/:id", DeleteBookHandler)
+	admin.Get("/book/:id/delete-impact", GetBookDeleteImpactHandler)
+	admin.Post("/books/merge", MergeBooksHandler)
+	admin.Put("/books/featured", BulkSetFeaturedHandler)
+	admin.Post("/books/unfeature-out-of-stock", BulkUnfeatureOutOfStockHandler)
+	admin.Post("/books/normalize-genres", NormalizeGenresHandler)
 	admin.Get("/users", GetAllUsersHandler)
+	admin.Get("/users/recent", GetRecentSignupsHandler)
+	admin.Get("/users/:id/reviews", GetUserReviewsHandler)
 	admin.Get("/user/:id", GetUserByIDHandler)
 	admin.Delete("/user/:id", DeleteUserHandler)
+	admin.Get("/user/:id/notes", GetUserNotesHandler)
+	admin.Post("/user/:id/notes", AddUserNoteHandler)
+	admin.Get("/user/:id/activity", GetUserActivityHandler)
 	admin.Get("/book/:id/download", DownloadBookHandler)
 	admin.Get("/book/:book_id/reviews", GetBookReviewsHandler)
+	admin.Get("/reviews", GetReviewsHandler)
 	admin.Get("/cart", GetAllCartItemsHandler)
+	admin.Get("/orders", GetAllOrdersHandler)
+	admin.Get("/orders/:ref", GetOrderHandler)
 	admin.Get("/cart/:user_id", GetUserCartHandler)
 	admin.Delete("/cart/:user_id/:book_id", DeleteCartItemHandler)
 	admin.Post("/logout", LogoutHandler)
 	admin.Get("/role/:id", GetUserRoleHandler)
+
+	// Development-only helpers for populating test data
+	if os.Getenv("APP_ENV") == "development" {
+		admin.Post("/dev/seed-reviews", SeedReviewsHandler)
+	}
 }
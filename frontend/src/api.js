@@ -0,0 +1,84 @@
+const API_URL = 'http://localhost:8080';
+
+// Every backend response is wrapped in { success, data, error }. Return the data of a
+// successful response, or throw an Error with the server's message for a failed one.
+export async function readEnvelope(response) {
+    const body = await response.json();
+
+    if (!response.ok || !body.success) {
+        const error = new Error((body.error && body.error.message) || `HTTP error! Status: ${response.status}`);
+        error.status = response.status;
+        error.fields = body.error && body.error.fields;
+        throw error;
+    }
+
+    return body.data;
+}
+
+// Store the tokens of a login session
+export function storeSession({ token, refresh_token }) {
+    localStorage.setItem('token', token);
+    localStorage.setItem('refresh_token', refresh_token);
+}
+
+// Forget the stored login session
+export function clearSession() {
+    localStorage.removeItem('token');
+    localStorage.removeItem('refresh_token');
+}
+
+// Refresh tokens can only be used once, so requests that fail together share one refresh
+let refreshing = null;
+
+// Swap the stored refresh token for a new session. Resolves to whether it worked.
+function refreshSession() {
+    const refreshToken = localStorage.getItem('refresh_token');
+    if (!refreshToken) {
+        return Promise.resolve(false);
+    }
+
+    if (!refreshing) {
+        refreshing = fetch(`${API_URL}/refresh`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ refresh_token: refreshToken }),
+        })
+            .then((response) => readEnvelope(response))
+            .then((session) => {
+                storeSession(session);
+                return true;
+            })
+            .catch(() => {
+                clearSession();
+                return false;
+            })
+            .finally(() => {
+                refreshing = null;
+            });
+    }
+    return refreshing;
+}
+
+// Fetch an endpoint with the stored access token. A token the server reissues in the
+// X-Refreshed-Token header replaces the stored one, and a request rejected because the
+// token expired is retried once after refreshing the session.
+export async function apiFetch(url, options = {}) {
+    const send = () => fetch(url, {
+        ...options,
+        headers: {
+            ...options.headers,
+            'Authorization': `Bearer ${localStorage.getItem('token')}`,
+        },
+    });
+
+    let response = await send();
+    if (response.status === 401 && await refreshSession()) {
+        response = await send();
+    }
+
+    const refreshed = response.headers.get('X-Refreshed-Token');
+    if (refreshed) {
+        localStorage.setItem('token', refreshed);
+    }
+    return response;
+}
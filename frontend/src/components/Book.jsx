@@ -2,6 +2,7 @@ import React, { useEffect, useState } from 'react';
 import { useParams } from 'react-router-dom';
 import Navbar from './Navbar';
 import ReviewSection from './ReviewSection';
+import { apiFetch, readEnvelope } from '../api';
 
 const BookDetail = () => {
     const [book, setBook] = useState(null);
@@ -12,7 +13,7 @@ const BookDetail = () => {
         const fetchBookDetails = async () => {
             try {
                 const token = localStorage.getItem('token');
-                const response = await fetch(`http://localhost:8080/user/book/${id}`, {
+                const response = await apiFetch(`http://localhost:8080/user/book/${id}`, {
                     method: 'GET',
                     headers: {
                         'Authorization': `Bearer ${token}`,
@@ -23,7 +24,7 @@ const BookDetail = () => {
                     throw new Error('Failed to fetch book details');
                 }
 
-                const data = await response.json();
+                const data = await readEnvelope(response);
                 setBook(data);
             } catch (error) {
                 console.error('Error fetching book details:', error);
@@ -53,7 +54,7 @@ const BookDetail = () => {
             // Ensure that quantity is a number (convert it to a number)
             const quantityAsNumber = parseInt(quantity);
 
-            const response = await fetch(`http://localhost:8080/user/cart`, {
+            const response = await apiFetch(`http://localhost:8080/user/cart`, {
                 method: 'POST',
                 headers: {
                     'Authorization': `Bearer ${token}`,
@@ -1,6 +1,7 @@
 import React, { useEffect, useState } from 'react';
 import Navbar from './Navbar';
 import { Link } from 'react-router-dom';
+import { apiFetch, readEnvelope } from '../api';
 
 const UserHome = () => {
   const [userName, setUserName] = useState('');
@@ -24,13 +25,13 @@ const UserHome = () => {
     const token = localStorage.getItem('token');
 
     if (token) {
-      fetch('http://localhost:8080/user', {
+      apiFetch('http://localhost:8080/user', {
         method: 'GET',
         headers: {
           'Authorization': `Bearer ${token}`,
         },
       })
-        .then((response) => response.json())
+        .then((response) => readEnvelope(response))
         .then((data) => {
           setUserName(data.name);
         })
@@ -38,13 +39,13 @@ const UserHome = () => {
           console.error('Error fetching user name:', error);
         });
 
-      fetch('http://localhost:8080/user/books', {
+      apiFetch('http://localhost:8080/user/books', {
         method: 'GET',
         headers: {
           'Authorization': `Bearer ${token}`,
         },
       })
-        .then((response) => response.json())
+        .then((response) => readEnvelope(response))
         .then((data) => {
           setBooks(data.books);
         })
@@ -57,7 +58,7 @@ const UserHome = () => {
   const deleteBook = (bookId) => {
     const token = localStorage.getItem('token');
 
-    fetch(`http://localhost:8080/user/book/${bookId}`, {
+    apiFetch(`http://localhost:8080/user/book/${bookId}`, {
       method: 'DELETE',
       headers: {
         'Authorization': `Bearer ${token}`,
@@ -95,7 +96,7 @@ const UserHome = () => {
       return;
     }
 
-    fetch(`http://localhost:8080/book/${selectedBook.id}`, {
+    apiFetch(`http://localhost:8080/book/${selectedBook.id}`, {
       method: 'POST',
       headers: {
         'Authorization': `Bearer ${token}`,
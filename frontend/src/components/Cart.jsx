@@ -1,5 +1,6 @@
 import React, { useEffect, useState } from 'react';
 import Navbar from './Navbar';
+import { apiFetch, readEnvelope } from '../api';
 
 const Cart = () => {
     const [cartItems, setCartItems] = useState([]);
@@ -10,7 +11,7 @@ const Cart = () => {
 
         const fetchCartItems = async () => {
             try {
-                const response = await fetch('http://localhost:8080/user/cart', {
+                const response = await apiFetch('http://localhost:8080/user/cart', {
                     method: 'GET',
                     headers: {
                         'Authorization': `Bearer ${token}`,
@@ -21,7 +22,7 @@ const Cart = () => {
                     throw new Error('Failed to fetch cart items');
                 }
 
-                const data = await response.json();
+                const data = await readEnvelope(response);
                 setCartItems(data);
             } catch (error) {
                 console.error('Error fetching cart items:', error);
@@ -35,7 +36,7 @@ const Cart = () => {
         const token = localStorage.getItem('token');
 
         try {
-            const response = await fetch(`http://localhost:8080/user/book/${bookId}`, {
+            const response = await apiFetch(`http://localhost:8080/user/book/${bookId}`, {
                 method: 'GET',
                 headers: {
                     'Authorization': `Bearer ${token}`,
@@ -46,7 +47,7 @@ const Cart = () => {
                 throw new Error('Failed to fetch book details');
             }
 
-            const data = await response.json();
+            const data = await readEnvelope(response);
             return data;
         } catch (error) {
             console.error('Error fetching book details:', error);
@@ -83,7 +84,7 @@ const Cart = () => {
         const token = localStorage.getItem('token');
 
         try {
-            const response = await fetch(`http://localhost:8080/user/cart/${bookId}`, {
+            const response = await apiFetch(`http://localhost:8080/user/cart/${bookId}`, {
                 method: 'DELETE',
                 headers: {
                     'Authorization': `Bearer ${token}`,
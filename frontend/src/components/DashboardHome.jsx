@@ -1,6 +1,7 @@
 import React, { useState } from 'react';
 import Navbar from './Navbar';
 import { Link } from 'react-router-dom';
+import { apiFetch } from '../api';
 
 const DashboardHome = () => {
   const [bookData, setBookData] = useState({
@@ -30,7 +31,7 @@ const DashboardHome = () => {
     // Assuming you have the JWT token stored in localStorage as 'token'
     const token = localStorage.getItem('token');
 
-    fetch('http://localhost:8080/admin/book', {
+    apiFetch('http://localhost:8080/admin/book', {
       method: 'POST',
       headers: {
         'Authorization': `Bearer ${token}`,
@@ -1,6 +1,7 @@
 import React, { useState } from 'react';
 import '../App.css';
 import LoginImg from '../../public/login-img.svg';
+import { readEnvelope, storeSession } from '../api';
 
 function Login() {
     // State to store user input
@@ -31,20 +32,17 @@ function Login() {
             body: JSON.stringify(formData),
         });
 
-        // Get response from the backend
-        const body = await response.json();
-
         // Check for successful login or display an error message
-        if (response.status === 200) {
-            // Assuming the backend returns a 'token' field in the response
-            const { token } = body;
+        try {
+            // The backend returns the access token and the refresh token that renews it
+            const session = await readEnvelope(response);
 
-            // Store the token in localStorage or a more secure storage method
-            localStorage.setItem('token', token);
+            // Store the tokens in localStorage or a more secure storage method
+            storeSession(session);
 
             // Redirect to the user's home page
             window.location.href = '/home';
-        } else {
+        } catch (error) {
             // Handle login failure
             alert("Invalid email or password. Please try again.");
         }
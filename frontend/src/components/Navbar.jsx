@@ -1,6 +1,7 @@
 import React, { useState, useEffect } from 'react';
 import { Link } from 'react-router-dom';
 import jwtDecode from 'jwt-decode'; // Import the JWT decode library
+import { apiFetch, readEnvelope } from '../api';
 
 const Navbar = () => {
     // State to manage the visibility of the profile dropdown
@@ -40,14 +41,14 @@ const Navbar = () => {
             if (decodedToken && decodedToken.user_id) {
                 const userId = decodedToken.user_id;
                 // Make a GET request to fetch the user's role
-                fetch(`http://localhost:8080/admin/role/${userId}`, {
+                apiFetch(`http://localhost:8080/admin/role/${userId}`, {
                     method: 'GET',
                     headers: {
                         'Authorization': `Bearer ${token}`,
                         'Content-Type': 'application/json',
                     },
                 })
-                    .then((response) => response.json())
+                    .then((response) => readEnvelope(response))
                     .then((data) => {
                         if (data && data.role) {
                             setUserRole(data.role); // Set the userRole state
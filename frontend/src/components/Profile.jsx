@@ -1,6 +1,7 @@
 import React, { useState, useEffect } from 'react';
 import { useParams, useNavigate } from 'react-router-dom';
 import Navbar from './Navbar';
+import { apiFetch, clearSession, readEnvelope } from '../api';
 
 const ProfileInfo = () => {
     const { id } = useParams();
@@ -13,13 +14,14 @@ const ProfileInfo = () => {
         lastname: userData.lastname || '',
         email: userData.email || '',
         password: '', // You can add password editing functionality here
+        current_password: '', // Required by the server to change the password
     });
 
     // Function to save the edited data
     const saveChanges = () => {
         // Send edited data to the server and update user data on success
         // Make a PUT request to update the user's profile
-        fetch(`http://localhost:8080/user/profile/${id}`, {
+        apiFetch(`http://localhost:8080/user/profile/${id}`, {
             method: 'PUT',
             headers: {
                 'Authorization': `Bearer ${localStorage.getItem('token')}`,
@@ -27,7 +29,7 @@ const ProfileInfo = () => {
             },
             body: JSON.stringify(editedData),
         })
-            .then((response) => response.json())
+            .then((response) => readEnvelope(response))
             .then((data) => {
                 setUserData(data);
                 setIsEditing(false);
@@ -39,16 +41,16 @@ const ProfileInfo = () => {
 
     // Function to deactivate the user account
     const deactivateAccount = () => {
-        fetch(`http://localhost:8080/user/deactivate/${id}`, {
+        apiFetch(`http://localhost:8080/user/deactivate/${id}`, {
             method: 'PUT',
             headers: {
                 'Authorization': `Bearer ${localStorage.getItem('token')}`,
             },
         })
-            .then((response) => response.json())
+            .then((response) => readEnvelope(response))
             .then(() => {
                 // Redirect to the login page after deactivation
-                localStorage.removeItem('token'); // Clear the token
+                clearSession(); // Clear the tokens
                 navigate('/login');
             })
             .catch((error) => {
@@ -58,16 +60,16 @@ const ProfileInfo = () => {
 
     // Function to delete the user account
     const deleteAccount = () => {
-        fetch(`http://localhost:8080/user/delete/${id}`, {
+        apiFetch(`http://localhost:8080/user/delete/${id}`, {
             method: 'DELETE',
             headers: {
                 'Authorization': `Bearer ${localStorage.getItem('token')}`,
             },
         })
-            .then((response) => response.json())
+            .then((response) => readEnvelope(response))
             .then(() => {
                 // Redirect to the login page after deletion
-                localStorage.removeItem('token'); // Clear the token
+                clearSession(); // Clear the tokens
                 navigate('/login');
             })
             .catch((error) => {
@@ -77,13 +79,13 @@ const ProfileInfo = () => {
 
     useEffect(() => {
         // Fetch user profile data
-        fetch(`http://localhost:8080/user/profile/${id}`, {
+        apiFetch(`http://localhost:8080/user/profile/${id}`, {
             method: 'GET',
             headers: {
                 'Authorization': `Bearer ${localStorage.getItem('token')}`,
             },
         })
-            .then((response) => response.json())
+            .then((response) => readEnvelope(response))
             .then((data) => {
                 setUserData(data);
                 setIsLoading(false);
@@ -163,6 +165,17 @@ const ProfileInfo = () => {
                         </div>
                     ) : null}
 
+                    {isEditing && editedData.password ? (
+                        <div className="mb-4">
+                            <label className="font-semibold">Current Password:</label>
+                            <input
+                                type="password"
+                                value={editedData.current_password}
+                                onChange={(e) => setEditedData({ ...editedData, current_password: e.target.value })}
+                            />
+                        </div>
+                    ) : null}
+
                     <div className="flex space-x-4">
                         {isEditing ? (
                             <button
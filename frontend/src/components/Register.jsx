@@ -1,6 +1,7 @@
 import React, { useState } from 'react';
 import '../App.css';
 import LoginImg from '../../public/login-img.svg';
+import { readEnvelope } from '../api';
 
 function Registration() {
     // State to store user input
@@ -34,15 +35,13 @@ function Registration() {
             body: JSON.stringify(formData),
         });
 
-        // Get response from the backend
-        const body = await response.json();
-
         // Check for successful registration or display an error message
-        if (response.status === 200) {
+        try {
+            await readEnvelope(response);
             alert('Registration successful! You can now log in.');
             window.location.href = '/login'; // Redirect to the login page
-        } else {
-            alert(body.message); // Display registration error message
+        } catch (error) {
+            alert(error.message); // Display registration error message
         }
     };
 
@@ -1,4 +1,5 @@
 import React, { useEffect, useState } from 'react';
+import { apiFetch, readEnvelope } from '../api';
 
 const ReviewSection = ({ bookId }) => {
     const [reviews, setReviews] = useState([]);
@@ -10,7 +11,7 @@ const ReviewSection = ({ bookId }) => {
         // Fetch reviews for the book with the given bookId
         const token = localStorage.getItem('token');
 
-        fetch(`http://localhost:8080/user/book/${bookId}/reviews`, {
+        apiFetch(`http://localhost:8080/user/book/${bookId}/reviews`, {
             method: 'GET',
             headers: {
                 'Authorization': `Bearer ${token}`,
@@ -21,7 +22,7 @@ const ReviewSection = ({ bookId }) => {
                 if (!response.ok) {
                     throw new Error('Failed to fetch reviews');
                 }
-                return response.json();
+                return readEnvelope(response);
             })
             .then((data) => {
                 setReviews(data);
@@ -46,7 +47,7 @@ const ReviewSection = ({ bookId }) => {
 
         // Submit a new review along with the rating
         const token = localStorage.getItem('token');
-        fetch(`http://localhost:8080/user/book/${bookId}/reviews`, {
+        apiFetch(`http://localhost:8080/user/book/${bookId}/reviews`, {
             method: 'POST',
             headers: {
                 'Authorization': `Bearer ${token}`,
@@ -57,7 +58,7 @@ const ReviewSection = ({ bookId }) => {
                 comment: newReview,
             }),
         })
-            .then((response) => response.json())
+            .then((response) => readEnvelope(response))
             .then((data) => {
                 // Add the new review to the reviews state
                 setReviews([...reviews, data]);
@@ -1,6 +1,7 @@
 import React, { useEffect, useState } from 'react';
 import Navbar from './Navbar';
 import { Link } from 'react-router-dom';
+import { apiFetch, readEnvelope } from '../api';
 
 const UserHome = () => {
   // State to store user's name
@@ -15,13 +16,13 @@ const UserHome = () => {
     // Check if the token exists
     if (token) {
       // Fetch the user's name from your backend API
-      fetch('http://localhost:8080/user', {
+      apiFetch('http://localhost:8080/user', {
         method: 'GET',
         headers: {
           'Authorization': `Bearer ${token}`,
         },
       })
-        .then((response) => response.json())
+        .then((response) => readEnvelope(response))
         .then((data) => {
           // Set the user's name from the API response
           setUserName(data.name);
@@ -31,13 +32,13 @@ const UserHome = () => {
         });
 
       // Fetch the list of books from your backend API
-      fetch('http://localhost:8080/user/books', {
+      apiFetch('http://localhost:8080/user/books', {
         method: 'GET',
         headers: {
           'Authorization': `Bearer ${token}`, // Include the token in the headers
         },
       })
-        .then((response) => response.json())
+        .then((response) => readEnvelope(response))
         .then((data) => {
           // Set the list of books from the API response
           console.log(data.books);
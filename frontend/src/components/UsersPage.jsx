@@ -1,6 +1,7 @@
 import React, { useState, useEffect } from 'react';
 import { Link } from 'react-router-dom';
 import Navbar from './Navbar';
+import { apiFetch, readEnvelope } from '../api';
 
 const UsersPage = () => {
   const [users, setUsers] = useState([]);
@@ -11,7 +12,7 @@ const UsersPage = () => {
     const token = localStorage.getItem('token');
 
     // Fetch users data from the admin API endpoint with the JWT token
-    fetch('http://localhost:8080/admin/users', {
+    apiFetch('http://localhost:8080/admin/users', {
       method: 'GET',
       headers: {
         'Authorization': `Bearer ${token}`,
@@ -22,7 +23,7 @@ const UsersPage = () => {
         if (!response.ok) {
           throw new Error(`HTTP error! Status: ${response.status}`);
         }
-        return response.json();
+        return readEnvelope(response);
       })
       .then((data) => {
         setUsers(data);
@@ -36,7 +37,7 @@ const UsersPage = () => {
     const token = localStorage.getItem('token');
 
     // Send a DELETE request to the backend to delete the user
-    fetch(`http://localhost:8080/admin/user/${id}`, {
+    apiFetch(`http://localhost:8080/admin/user/${id}`, {
       method: 'DELETE',
       headers: {
         'Authorization': `Bearer ${token}`,